@@ -0,0 +1,273 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"io"
+	"log/slog"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// AgentPeer is how peers are exchanged between a node agent and the central instance, keys are only filled in by exports
+type AgentPeer struct {
+	Name            string  `json:"name"`
+	Role            string  `json:"role"`
+	Interface       string  `json:"interface"`
+	Address         string  `json:"address"`
+	PublicKey       string  `json:"publicKey"`
+	PrivateKey      string  `json:"privateKey,omitempty"`
+	PresharedKey    string  `json:"presharedKey,omitempty"`
+	ExpiresAt       uint64  `json:"expiresAt"`
+	AllowedUsage    uint64  `json:"allowedUsage"`
+	TotalUsage      uint64  `json:"totalUsage"`
+	LatestHandshake uint64  `json:"latestHandshake"`
+	CurrentRx       uint64  `json:"currentRx"`
+	CurrentTx       uint64  `json:"currentTx"`
+	Suspended       bool    `json:"suspended"`
+	Disabled        bool    `json:"disabled"`
+	DisabledReason  string  `json:"disabledReason,omitempty"`
+	DisabledAt      uint64  `json:"disabledAt,omitempty"`
+	DisabledBy      string  `json:"disabledBy,omitempty"`
+	Email           string  `json:"email,omitempty"`
+	TelegramToken   string  `json:"telegramToken,omitempty"`
+	TelegramChatIDs []int64 `json:"telegramChatIDs,omitempty"`
+}
+
+// AgentPeerStateRequest is the optional body of a suspend or resume, with the reason and the admin on the central instance
+type AgentPeerStateRequest struct {
+	Reason string `json:"reason"`
+	Actor  string `json:"actor"`
+}
+
+type AgentCreatePeerRequest struct {
+	Role         string `json:"role"`
+	Interface    string `json:"interface"`
+	Days         uint64 `json:"days"`
+	AllowedUsage uint64 `json:"allowedUsage"`
+}
+
+func toAgentPeer(p *Peer, withSecrets bool) AgentPeer {
+	ap := AgentPeer{
+		Name:            p.Name,
+		Role:            p.Role,
+		Interface:       p.Interface,
+		Address:         p.Address,
+		PublicKey:       p.PublicKey,
+		ExpiresAt:       p.ExpiresAt,
+		AllowedUsage:    p.AllowedUsage,
+		TotalUsage:      p.TotalUsage,
+		LatestHandshake: p.LatestHandshake,
+		CurrentRx:       p.CurrentRx,
+		CurrentTx:       p.CurrentTx,
+		Suspended:       p.Suspended,
+		Disabled:        p.Disabled,
+		DisabledReason:  p.DisabledReason,
+		DisabledAt:      p.DisabledAt,
+		DisabledBy:      p.DisabledBy,
+	}
+	if withSecrets {
+		ap.PrivateKey = p.PrivateKey
+		ap.PresharedKey = p.PresharedKey
+		ap.Email = p.Email
+		ap.TelegramToken = p.TelegramToken
+		ap.TelegramChatIDs = p.TelegramChatIDs
+	}
+	return ap
+}
+
+func agentPeers() []AgentPeer {
+	peers := []AgentPeer{}
+	for _, p := range config.Peers {
+		peers = append(peers, toAgentPeer(p, false))
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Name < peers[j].Name })
+	return peers
+}
+
+// importPeer adds a peer exported by another node, keeping its keys, limits, usage and telegram links
+func importPeer(ap AgentPeer) (*Peer, error) {
+	if ap.Name == "" || ap.PublicKey == "" || ap.PrivateKey == "" || ap.PresharedKey == "" {
+		return nil, errors.New("name and keys are required")
+	}
+	if err := validatePeerName(ap.Name); err != nil {
+		return nil, err
+	}
+	email, err := validateEmail(ap.Email)
+	if err != nil {
+		return nil, err
+	}
+	peer := &Peer{
+		ID:              primitive.NewObjectID(),
+		Name:            ap.Name,
+		PublicKey:       ap.PublicKey,
+		PrivateKey:      ap.PrivateKey,
+		PresharedKey:    ap.PresharedKey,
+		Interface:       ap.Interface,
+		ExpiresAt:       ap.ExpiresAt,
+		AllowedUsage:    ap.AllowedUsage,
+		TotalUsage:      ap.TotalUsage,
+		Disabled:        ap.Disabled,
+		DisabledReason:  ap.DisabledReason,
+		DisabledAt:      ap.DisabledAt,
+		DisabledBy:      ap.DisabledBy,
+		Role:            ap.Role,
+		Email:           email,
+		TelegramToken:   ap.TelegramToken,
+		TelegramChatIDs: ap.TelegramChatIDs,
+	}
+	if peer.TelegramChatIDs == nil {
+		peer.TelegramChatIDs = []int64{}
+	}
+	if err = addPeer(peer); err != nil {
+		return nil, err
+	}
+	return peer, nil
+}
+
+// agentAuth rejects requests that don't carry the configured agent token
+func agentAuth(c *gin.Context) {
+	updateMutex.RLock()
+	expected := "Bearer " + config.AgentToken
+	updateMutex.RUnlock()
+	if subtle.ConstantTimeCompare([]byte(c.GetHeader("Authorization")), []byte(expected)) != 1 {
+		c.AbortWithStatus(401)
+		return
+	}
+	c.Next()
+}
+
+// runAgent serves the node agent API used by a central instance to manage this server's peers, over TLS unless
+// Config.validate allowed plain HTTP on a loopback address
+func runAgent() {
+	r := agentRouter()
+	slog.Info("node agent listening", "address", config.AgentAddress, "tls", config.AgentCertFile != "")
+	var err error
+	if config.AgentCertFile != "" {
+		err = r.RunTLS(config.AgentAddress, config.AgentCertFile, config.AgentKeyFile)
+	} else {
+		err = r.Run(config.AgentAddress)
+	}
+	if err != nil {
+		slog.Error("node agent stopped", "error", err)
+	}
+}
+
+// agentRouter returns the handler of the node agent API
+func agentRouter() *gin.Engine {
+	r := gin.New()
+	r.Use(accessLog, gin.CustomRecovery(recoverPanics), agentAuth)
+	r.GET("/agent/peers", readPeers, func(c *gin.Context) {
+		c.JSON(200, agentPeers())
+	})
+	r.GET("/agent/stats", func(c *gin.Context) {
+		c.Stream(func(w io.Writer) bool {
+			updateMutex.RLock()
+			peers := agentPeers()
+			updateMutex.RUnlock()
+			c.SSEvent("stats", peers)
+			time.Sleep(time.Second)
+			return true
+		})
+	})
+	r.GET("/agent/peers/:name/export", readPeers, func(c *gin.Context) {
+		peer := findPeerByName(c.Param("name"))
+		if peer == nil {
+			c.AbortWithStatus(404)
+			return
+		}
+		c.JSON(200, toAgentPeer(peer, true))
+	})
+	r.POST("/agent/peers/:name", lockPeers, func(c *gin.Context) {
+		req := AgentCreatePeerRequest{}
+		if err := c.BindJSON(&req); err != nil {
+			return
+		}
+		var plan *Plan
+		if req.Days != 0 || req.AllowedUsage != 0 {
+			plan = &Plan{Name: "agent", Days: req.Days, AllowedUsage: req.AllowedUsage}
+			if plan.Days == 0 {
+				plan.Days = 30
+			}
+			if plan.AllowedUsage == 0 {
+				plan.AllowedUsage = 50 * gigabyte
+			}
+		}
+		role := req.Role
+		if role == "" {
+			role = "user"
+		}
+		p, err := createPeer(c.Param("name"), role, req.Interface, plan)
+		if err != nil {
+			c.Error(err)
+			c.JSON(400, map[string]interface{}{"error": err.Error()})
+			return
+		}
+		c.JSON(201, toAgentPeer(p, false))
+	})
+	r.POST("/agent/import", lockPeers, func(c *gin.Context) {
+		ap := AgentPeer{}
+		if err := c.BindJSON(&ap); err != nil {
+			return
+		}
+		p, err := importPeer(ap)
+		if err != nil {
+			c.Error(err)
+			c.JSON(400, map[string]interface{}{"error": err.Error()})
+			return
+		}
+		c.JSON(201, toAgentPeer(p, false))
+	})
+	r.DELETE("/agent/peers/:name", lockPeers, func(c *gin.Context) {
+		err := deletePeer(c.Param("name"), "agent", c.Query("purge") == "true")
+		if err != nil {
+			if err.Error() == "peer not found" {
+				c.AbortWithStatus(404)
+			} else if err == errTrashNameTaken {
+				c.JSON(409, map[string]interface{}{"error": err.Error()})
+			} else {
+				c.Error(err)
+				c.JSON(500, map[string]interface{}{"error": err.Error()})
+			}
+			return
+		}
+		c.AbortWithStatus(200)
+	})
+	r.POST("/agent/peers/:name/:action", lockPeers, func(c *gin.Context) {
+		peer := findPeerByName(c.Param("name"))
+		if peer == nil {
+			c.AbortWithStatus(404)
+			return
+		}
+		req := AgentPeerStateRequest{}
+		if c.Request.ContentLength != 0 {
+			if err := c.BindJSON(&req); err != nil {
+				c.Error(err)
+				return
+			}
+		}
+		var err error
+		switch c.Param("action") {
+		case "suspend":
+			err = setPeerDisabled(peer, true, req.Reason, req.Actor)
+		case "resume":
+			err = setPeerDisabled(peer, false, "", req.Actor)
+		default:
+			c.AbortWithStatus(404)
+			return
+		}
+		if err != nil {
+			c.Error(err)
+			c.JSON(500, map[string]interface{}{"error": err.Error()})
+			return
+		}
+		if err = applyPeerState(peer); err != nil {
+			slog.Error("could not apply peer state", peerLog(peer), "error", err)
+		}
+		c.JSON(200, toAgentPeer(peer, false))
+	})
+	return r
+}
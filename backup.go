@@ -0,0 +1,635 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/crypto/scrypt"
+)
+
+// backupVersion is the archive format written by this version, older formats can still be restored
+const backupVersion = 1
+
+// encryptedBackupMagic starts every encrypted archive, plain archives are zip files
+var encryptedBackupMagic = []byte("WGUIENC1")
+
+type BackupConfig struct {
+	// Dir enables scheduled backups to this folder
+	Dir string `json:"dir"`
+	// IntervalHours is the time between scheduled backups, defaults to 24
+	IntervalHours int `json:"intervalHours"`
+	// Keep is how many scheduled backups are kept, defaults to 7
+	Keep int `json:"keep"`
+	// Passphrase encrypts scheduled backups and is the default passphrase of the backup commands
+	Passphrase string `json:"passphrase"`
+}
+
+func (b *BackupConfig) setDefaults() {
+	if b.IntervalHours == 0 {
+		b.IntervalHours = 24
+	}
+	if b.Keep == 0 {
+		b.Keep = 7
+	}
+}
+
+func (b *BackupConfig) validate() []error {
+	var problems []error
+	if b.IntervalHours < 0 {
+		problems = append(problems, errors.New("backup: intervalHours can't be negative"))
+	}
+	if b.Keep < 0 {
+		problems = append(problems, errors.New("backup: keep can't be negative"))
+	}
+	if b.Dir != "" {
+		if info, err := os.Stat(b.Dir); err != nil || !info.IsDir() {
+			problems = append(problems, fmt.Errorf("backup: dir %s is not a directory", b.Dir))
+		}
+	}
+	return problems
+}
+
+// BackupManifest describes an archive, it is stored as manifest.json
+type BackupManifest struct {
+	Version    int      `json:"version"`
+	CreatedAt  int64    `json:"createdAt"`
+	Hostname   string   `json:"hostname"`
+	Peers      int      `json:"peers"`
+	Interfaces []string `json:"interfaces"`
+	Config     bool     `json:"config"`
+}
+
+// Backup is a read and validated archive
+type Backup struct {
+	Manifest BackupManifest
+	// Config is config.json as it was on disk, without environment overrides
+	Config []byte
+	// Interfaces holds the /etc/wireguard config file of every interface, keyed by name
+	Interfaces map[string][]byte
+	// Peers are the stored peer documents with every field, including keys and usage
+	Peers []bson.Raw
+}
+
+type RestoreResult struct {
+	Manifest   BackupManifest `json:"manifest"`
+	Interfaces []string       `json:"interfaces"`
+	Peers      int            `json:"peers"`
+	Config     bool           `json:"config"`
+	// Reload is the result of applying the restored config to the running server
+	Reload *ReloadResult `json:"reload,omitempty"`
+}
+
+// backupPassphrase reads the passphrase from file, or falls back to WIREGUARD_UI_BACKUP_PASSPHRASE and then
+// the configured one. An empty passphrase means the archive isn't encrypted.
+func backupPassphrase(file string) (string, error) {
+	if file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
+	if passphrase := os.Getenv(configEnvironmentPrefix + "BACKUP_PASSPHRASE"); passphrase != "" {
+		return passphrase, nil
+	}
+	return config.Backup.Passphrase, nil
+}
+
+// writeBackup writes an archive of config.json, the interface config files and every stored peer to w,
+// encrypted when passphrase isn't empty. The caller holds updateMutex, its read lock is enough, so the update loop
+// can't change peers or config files between the flush and the snapshot.
+func writeBackup(w io.Writer, passphrase string) (*BackupManifest, error) {
+	// usage and flags that haven't reached the database yet belong in the backup
+	if err := flushQueuedWrites(true); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	cursor, err := config.Collection.Find(ctx, bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	var documents []bson.Raw
+	if err = cursor.All(ctx, &documents); err != nil {
+		return nil, err
+	}
+	var peers bytes.Buffer
+	peers.WriteString("[")
+	for i, d := range documents {
+		extJSON, err := bson.MarshalExtJSON(d, true, false)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			peers.WriteString(",")
+		}
+		peers.WriteString("\n")
+		peers.Write(extJSON)
+	}
+	peers.WriteString("\n]\n")
+
+	hostname, _ := os.Hostname()
+	manifest := &BackupManifest{Version: backupVersion, CreatedAt: time.Now().Unix(), Hostname: hostname, Peers: len(documents)}
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	add := func(name string, data []byte) error {
+		f, err := archive.Create(name)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(data)
+		return err
+	}
+	for _, iface := range config.Interfaces {
+		data, err := os.ReadFile(iface.ConfigPath())
+		if err != nil {
+			return nil, err
+		}
+		if err = add("wireguard/"+iface.Name+".conf", data); err != nil {
+			return nil, err
+		}
+		manifest.Interfaces = append(manifest.Interfaces, iface.Name)
+	}
+	if configFile != "" {
+		data, err := os.ReadFile(configFile)
+		if err != nil {
+			return nil, err
+		}
+		if err = add("config.json", data); err != nil {
+			return nil, err
+		}
+		manifest.Config = true
+	}
+	if err = add("peers.json", peers.Bytes()); err != nil {
+		return nil, err
+	}
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err = add("manifest.json", manifestJSON); err != nil {
+		return nil, err
+	}
+	if err = archive.Close(); err != nil {
+		return nil, err
+	}
+
+	data := buf.Bytes()
+	if passphrase != "" {
+		if data, err = encryptBackup(data, passphrase); err != nil {
+			return nil, err
+		}
+	}
+	_, err = w.Write(data)
+	return manifest, err
+}
+
+// backupKey derives the AES-256 key of an encrypted archive from the passphrase
+func backupKey(passphrase string, salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+}
+
+// encryptBackup seals data with AES-GCM, the result is the magic, the salt, the nonce and the ciphertext
+func encryptBackup(data []byte, passphrase string) ([]byte, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key, err := backupKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := append(append(append([]byte{}, encryptedBackupMagic...), salt...), nonce...)
+	return gcm.Seal(sealed, nonce, data, encryptedBackupMagic), nil
+}
+
+func decryptBackup(data []byte, passphrase string) ([]byte, error) {
+	if passphrase == "" {
+		return nil, errors.New("backup is encrypted, a passphrase is required")
+	}
+	data = data[len(encryptedBackupMagic):]
+	if len(data) < 16 {
+		return nil, errors.New("backup is truncated")
+	}
+	key, err := backupKey(passphrase, data[:16])
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	data = data[16:]
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("backup is truncated")
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], encryptedBackupMagic)
+	if err != nil {
+		return nil, errors.New("wrong passphrase or damaged backup")
+	}
+	return plain, nil
+}
+
+// readBackup decrypts and unpacks an archive and checks that its peers are complete and match the interface config files
+func readBackup(data []byte, passphrase string) (*Backup, error) {
+	var err error
+	if bytes.HasPrefix(data, encryptedBackupMagic) {
+		if data, err = decryptBackup(data, passphrase); err != nil {
+			return nil, err
+		}
+	}
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("not a backup: %s", err)
+	}
+
+	b := &Backup{Interfaces: map[string][]byte{}}
+	var manifestJSON, peersJSON []byte
+	for _, f := range archive.File {
+		r, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		content, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case f.Name == "manifest.json":
+			manifestJSON = content
+		case f.Name == "peers.json":
+			peersJSON = content
+		case f.Name == "config.json":
+			b.Config = content
+		case strings.HasPrefix(f.Name, "wireguard/") && strings.HasSuffix(f.Name, ".conf"):
+			name := strings.TrimSuffix(strings.TrimPrefix(f.Name, "wireguard/"), ".conf")
+			if name == "" || strings.ContainsAny(name, "/\\") || name == "." || name == ".." {
+				return nil, fmt.Errorf("invalid interface file %s", f.Name)
+			}
+			b.Interfaces[name] = content
+		}
+	}
+	if manifestJSON == nil || peersJSON == nil {
+		return nil, errors.New("not a backup: manifest.json or peers.json is missing")
+	}
+	if err = json.Unmarshal(manifestJSON, &b.Manifest); err != nil {
+		return nil, fmt.Errorf("manifest.json: %s", err)
+	}
+	if b.Manifest.Version < 1 || b.Manifest.Version > backupVersion {
+		return nil, fmt.Errorf("backup version %d isn't supported, this server reads versions 1 to %d", b.Manifest.Version, backupVersion)
+	}
+	var documents []json.RawMessage
+	if err = json.Unmarshal(peersJSON, &documents); err != nil {
+		return nil, fmt.Errorf("peers.json: %s", err)
+	}
+	for _, d := range documents {
+		var raw bson.Raw
+		if err = bson.UnmarshalExtJSON(d, true, &raw); err != nil {
+			return nil, fmt.Errorf("peers.json: %s", err)
+		}
+		b.Peers = append(b.Peers, raw)
+	}
+	if b.Config != nil {
+		var c Config
+		if err = json.Unmarshal(b.Config, &c); err != nil {
+			return nil, fmt.Errorf("config.json: %s", err)
+		}
+	}
+	if err = b.validate(); err != nil {
+		return nil, fmt.Errorf("backup has problems:\n%w", err)
+	}
+	return b, nil
+}
+
+// validate checks every peer has its keys, a unique name, key and address, and is listed in its interface's config file
+func (b *Backup) validate() error {
+	var problems []error
+	problem := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Errorf(format, a...))
+	}
+
+	interfacePeers := map[string]map[string]bool{}
+	for _, name := range b.Manifest.Interfaces {
+		data, ok := b.Interfaces[name]
+		if !ok {
+			problem("interface %s is listed in the manifest but its config file is missing", name)
+			continue
+		}
+		interfacePeers[name] = map[string]bool{}
+		hasKey := false
+		for _, section := range parseWireguardConfig(string(data)) {
+			switch section.Name {
+			case "Interface":
+				hasKey = section.Values["PrivateKey"] != ""
+			case "Peer":
+				interfacePeers[name][section.Values["PublicKey"]] = true
+			}
+		}
+		if !hasKey {
+			problem("interface %s: config file has no private key", name)
+		}
+	}
+
+	names := map[string]bool{}
+	publicKeys := map[string]bool{}
+	addresses := map[string]bool{}
+	for i, raw := range b.Peers {
+		var p Peer
+		if err := bson.Unmarshal(raw, &p); err != nil {
+			problem("peer %d: %s", i+1, err)
+			continue
+		}
+		if p.Name == "" {
+			problem("peer %d has no name", i+1)
+			continue
+		}
+		// peers adopted from an interface have no private key
+		if p.PublicKey == "" || p.PresharedKey == "" {
+			problem("peer %s: keys are missing", p.Name)
+		}
+		if _, err := netip.ParseAddr(p.Address); err != nil {
+			problem("peer %s: invalid address %q", p.Name, p.Address)
+		}
+		// a peer in the trash may share its name with a live one, and is in no config file
+		trashed := p.DeletedAt != 0
+		nameKey := fmt.Sprintf("%t %s", trashed, p.Name)
+		if names[nameKey] {
+			problem("peer %s is listed twice", p.Name)
+		}
+		names[nameKey] = true
+		if publicKeys[p.PublicKey] {
+			problem("peer %s: public key is used by another peer", p.Name)
+		}
+		publicKeys[p.PublicKey] = true
+		if trashed {
+			continue
+		}
+
+		// peers created before interfaces were configurable belong to the first one
+		iface := p.Interface
+		if iface == "" && len(b.Manifest.Interfaces) > 0 {
+			iface = b.Manifest.Interfaces[0]
+		}
+		if addresses[iface+" "+p.Address] {
+			problem("peer %s: address %s on %s is used by another peer", p.Name, p.Address, iface)
+		}
+		addresses[iface+" "+p.Address] = true
+		if interfacePeers[iface] == nil {
+			problem("peer %s: interface %s isn't in the backup", p.Name, iface)
+		} else if !interfacePeers[iface][p.PublicKey] {
+			problem("peer %s isn't in the config file of %s", p.Name, iface)
+		}
+	}
+	return errors.Join(problems...)
+}
+
+// replaceFile writes data to path through a temporary file, keeping the previous content next to it with a .before-restore suffix
+func replaceFile(path string, data []byte, perm os.FileMode) error {
+	if previous, err := os.ReadFile(path); err == nil {
+		if err = os.WriteFile(path+".before-restore", previous, 0600); err != nil {
+			return err
+		}
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// restoreFiles writes the interface config files and, when configPath isn't empty, config.json from the backup.
+// The restored config is checked before it replaces the current one.
+func restoreFiles(b *Backup, configPath string) error {
+	names := make([]string, 0, len(b.Interfaces))
+	for name := range b.Interfaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		iface := &Interface{Name: name}
+		if err := replaceFile(iface.ConfigPath(), b.Interfaces[name], 0600); err != nil {
+			return err
+		}
+	}
+	if configPath == "" {
+		return nil
+	}
+	if b.Config == nil {
+		return errors.New("the backup has no config.json")
+	}
+	// check the config where it will live so relative paths resolve the same way
+	tmp := filepath.Join(filepath.Dir(configPath), ".config.json.restore")
+	if err := os.WriteFile(tmp, b.Config, 0600); err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	if _, err := readConfig(tmp); err != nil {
+		return err
+	}
+	return replaceFile(configPath, b.Config, 0600)
+}
+
+// restorePeers replaces every stored peer with the backup's. Writes queued for the replaced peers are dropped.
+func restorePeers(b *Backup) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 4*storeTimeout)
+	defer cancel()
+	discardQueuedWrites()
+	if _, err := config.Collection.DeleteMany(ctx, bson.D{}); err != nil {
+		return err
+	}
+	if len(b.Peers) == 0 {
+		return nil
+	}
+	documents := make([]interface{}, len(b.Peers))
+	for i, raw := range b.Peers {
+		documents[i] = raw
+	}
+	if _, err := config.Collection.InsertMany(ctx, documents); err != nil {
+		return fmt.Errorf("peers were removed but restoring them failed, run the restore again: %w", err)
+	}
+	return nil
+}
+
+// applyRestoredInterfaces brings up the restored interfaces, or applies their config files if they are already up
+func applyRestoredInterfaces(b *Backup) error {
+	for name := range b.Interfaces {
+		iface := &Interface{Name: name}
+		if _, err := iface.Dump(); err != nil {
+			if output, err := exec.Command("wg-quick", "up", name).CombinedOutput(); err != nil {
+				return fmt.Errorf("could not bring up %s: %s", name, strings.TrimSpace(string(output)))
+			}
+			continue
+		}
+		if err := iface.Sync(); err != nil {
+			return fmt.Errorf("could not apply %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// restoreBackup applies a backup to the running server, with config.json too when withConfig is set
+func restoreBackup(b *Backup, withConfig bool) (*RestoreResult, error) {
+	result, err := restoreBackupState(b, withConfig)
+	if err != nil {
+		return nil, err
+	}
+	// reloadConfig takes updateMutex itself, so the restored config is applied once the peers are in place
+	if withConfig {
+		reload, err := reloadConfig()
+		if err != nil {
+			return nil, err
+		}
+		result.Reload = reload
+	}
+	slog.Info("restored backup", "createdAt", b.Manifest.CreatedAt, "hostname", b.Manifest.Hostname, "peers", result.Peers, "interfaces", result.Interfaces, "config", withConfig)
+	return result, nil
+}
+
+// restoreBackupState writes the files of a backup and replaces the stored peers and the interfaces with its own
+func restoreBackupState(b *Backup, withConfig bool) (*RestoreResult, error) {
+	// keep the update loop from counting or suspending peers while they are replaced
+	updateMutex.Lock()
+	defer updateMutex.Unlock()
+
+	configPath := ""
+	if withConfig {
+		configPath = configFile
+	}
+	if err := restoreFiles(b, configPath); err != nil {
+		return nil, err
+	}
+	if err := restorePeers(b); err != nil {
+		return nil, err
+	}
+	if err := applyRestoredInterfaces(b); err != nil {
+		return nil, err
+	}
+	if err := syncPeersFromStore(); err != nil {
+		return nil, err
+	}
+	// restored peers already have transfer on the device that must not count as usage
+	loadTransferCounters(nil)
+
+	result := &RestoreResult{Manifest: b.Manifest, Peers: len(b.Peers), Config: withConfig, Interfaces: []string{}}
+	for name := range b.Interfaces {
+		result.Interfaces = append(result.Interfaces, name)
+	}
+	sort.Strings(result.Interfaces)
+	return result, nil
+}
+
+// backupFilePrefix starts the names of scheduled backups, only files with it are pruned
+const backupFilePrefix = "wireguard-ui-backup-"
+
+// scheduledBackups returns the scheduled backups in dir, oldest first
+func scheduledBackups(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasPrefix(e.Name(), backupFilePrefix) {
+			files = append(files, filepath.Join(dir, e.Name()))
+		}
+	}
+	// the names contain the time, so they sort by age
+	sort.Strings(files)
+	return files, nil
+}
+
+// createScheduledBackup writes a backup to the folder of b and removes the oldest ones beyond the number to keep
+func createScheduledBackup(b BackupConfig) error {
+	name := backupFilePrefix + time.Now().UTC().Format("20060102-150405") + ".zip"
+	if b.Passphrase != "" {
+		name += ".enc"
+	}
+	path := filepath.Join(b.Dir, name)
+	var buf bytes.Buffer
+	updateMutex.RLock()
+	manifest, err := writeBackup(&buf, b.Passphrase)
+	updateMutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	slog.Info("wrote backup", "file", path, "peers", manifest.Peers)
+
+	files, err := scheduledBackups(b.Dir)
+	if err != nil {
+		return err
+	}
+	for len(files) > b.Keep {
+		if err = os.Remove(files[0]); err != nil {
+			return err
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+// runScheduledBackups writes a backup whenever the newest one in the backup folder is older than the interval.
+// It reads the backup settings on every check so reloads take effect.
+func runScheduledBackups() {
+	var failedAt time.Time
+	for ; ; time.Sleep(time.Minute) {
+		updateMutex.RLock()
+		b := config.Backup
+		updateMutex.RUnlock()
+		// a failed backup is retried after ten minutes rather than on every check
+		if b.Dir == "" || time.Since(failedAt) < 10*time.Minute {
+			continue
+		}
+		files, err := scheduledBackups(b.Dir)
+		if err != nil {
+			slog.Error("could not list backups", "dir", b.Dir, "error", err)
+			continue
+		}
+		if len(files) > 0 {
+			info, err := os.Stat(files[len(files)-1])
+			if err == nil && time.Since(info.ModTime()) < time.Duration(b.IntervalHours)*time.Hour {
+				continue
+			}
+		}
+		if err = createScheduledBackup(b); err != nil {
+			failedAt = time.Now()
+			slog.Error("scheduled backup failed", "dir", b.Dir, "error", err)
+		}
+	}
+}
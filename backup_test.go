@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestEncryptBackup(t *testing.T) {
+	data := []byte("PK\x03\x04 a zip archive with every peer's keys")
+	sealed, err := encryptBackup(data, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(sealed, encryptedBackupMagic) || bytes.Contains(sealed, data) {
+		t.Fatal("the encrypted backup doesn't start with the magic or contains the plain archive")
+	}
+	plain, err := decryptBackup(sealed, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plain, data) {
+		t.Errorf("decrypted %q, want %q", plain, data)
+	}
+
+	// the salt and nonce are random, the same archive never encrypts the same way twice
+	again, err := encryptBackup(data, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(again, sealed) {
+		t.Error("two encryptions of the same archive are equal")
+	}
+
+	tampered := bytes.Clone(sealed)
+	tampered[len(tampered)-1] ^= 1
+	for name, test := range map[string]struct {
+		data       []byte
+		passphrase string
+	}{
+		"wrong passphrase":   {sealed, "wrong horse"},
+		"no passphrase":      {sealed, ""},
+		"changed ciphertext": {tampered, "correct horse"},
+		"truncated salt":     {sealed[:len(encryptedBackupMagic)+8], "correct horse"},
+		"truncated nonce":    {sealed[:len(encryptedBackupMagic)+20], "correct horse"},
+	} {
+		if _, err := decryptBackup(test.data, test.passphrase); err == nil {
+			t.Errorf("%s: the backup was decrypted", name)
+		}
+	}
+}
+
+// testBackup is a backup of wg0 with the peers, by default a valid one with two live peers and one in the trash
+func testBackup(t *testing.T, peers ...Peer) *Backup {
+	t.Helper()
+	b := &Backup{
+		Manifest: BackupManifest{Version: backupVersion, Interfaces: []string{"wg0"}},
+		Interfaces: map[string][]byte{
+			"wg0": []byte("[Interface]\nPrivateKey = server-key\nAddress = 10.0.0.1/24\n\n" +
+				"[Peer]\nPublicKey = pk-1\nPresharedKey = psk-1\nAllowedIPs = 10.0.0.2\n\n" +
+				"[Peer]\nPublicKey = pk-2\nPresharedKey = psk-2\nAllowedIPs = 10.0.0.3\n"),
+		},
+	}
+	if len(peers) == 0 {
+		peers = []Peer{
+			{Name: "shop-1", PublicKey: "pk-1", PresharedKey: "psk-1", Address: "10.0.0.2", Interface: "wg0"},
+			// peers from before interfaces were configurable belong to the first interface
+			{Name: "shop-2", PublicKey: "pk-2", PresharedKey: "psk-2", Address: "10.0.0.3"},
+			{Name: "shop-1", PublicKey: "pk-3", PresharedKey: "psk-3", Address: "10.0.0.2", Interface: "wg0", DeletedAt: 1},
+		}
+	}
+	for _, p := range peers {
+		raw, err := bson.Marshal(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Peers = append(b.Peers, raw)
+	}
+	return b
+}
+
+func TestBackupValidate(t *testing.T) {
+	if err := testBackup(t).validate(); err != nil {
+		t.Fatalf("valid backup has problems: %v", err)
+	}
+
+	shop1 := Peer{Name: "shop-1", PublicKey: "pk-1", PresharedKey: "psk-1", Address: "10.0.0.2", Interface: "wg0"}
+	tests := []struct {
+		name   string
+		backup func() *Backup
+		want   string
+	}{
+		{"missing interface file", func() *Backup {
+			b := testBackup(t)
+			delete(b.Interfaces, "wg0")
+			return b
+		}, "interface wg0 is listed in the manifest but its config file is missing"},
+		{"interface without a key", func() *Backup {
+			b := testBackup(t)
+			b.Interfaces["wg0"] = bytes.Replace(b.Interfaces["wg0"], []byte("PrivateKey = server-key"), nil, 1)
+			return b
+		}, "interface wg0: config file has no private key"},
+		{"unnamed peer", func() *Backup {
+			return testBackup(t, Peer{PublicKey: "pk-1", PresharedKey: "psk-1", Address: "10.0.0.2"})
+		}, "peer 1 has no name"},
+		{"missing keys", func() *Backup {
+			return testBackup(t, Peer{Name: "shop-1", PublicKey: "pk-1", Address: "10.0.0.2"})
+		}, "peer shop-1: keys are missing"},
+		{"invalid address", func() *Backup {
+			p := shop1
+			p.Address = "10.0.0.300"
+			return testBackup(t, p)
+		}, `peer shop-1: invalid address "10.0.0.300"`},
+		{"duplicate name", func() *Backup {
+			p := shop1
+			p.PublicKey, p.Address = "pk-2", "10.0.0.3"
+			return testBackup(t, shop1, p)
+		}, "peer shop-1 is listed twice"},
+		{"duplicate public key", func() *Backup {
+			p := shop1
+			p.Name, p.Address = "shop-2", "10.0.0.3"
+			return testBackup(t, shop1, p)
+		}, "peer shop-2: public key is used by another peer"},
+		{"duplicate address", func() *Backup {
+			p := shop1
+			p.Name, p.PublicKey = "shop-2", "pk-2"
+			return testBackup(t, shop1, p)
+		}, "peer shop-2: address 10.0.0.2 on wg0 is used by another peer"},
+		{"peer on an interface that isn't in the backup", func() *Backup {
+			p := shop1
+			p.Interface = "wg1"
+			return testBackup(t, p)
+		}, "peer shop-1: interface wg1 isn't in the backup"},
+		{"peer missing from the config file", func() *Backup {
+			p := shop1
+			p.PublicKey = "pk-9"
+			return testBackup(t, p)
+		}, "peer shop-1 isn't in the config file of wg0"},
+	}
+	for _, test := range tests {
+		err := test.backup().validate()
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got %v, want %q", test.name, err, test.want)
+		}
+	}
+}
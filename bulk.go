@@ -0,0 +1,343 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxBulkItems limits how many peers a single bulk request can create or change
+const maxBulkItems = 500
+
+// normalizeTags trims the tags and drops empty and repeated ones
+func normalizeTags(tags []string) []string {
+	normalized := []string{}
+	for _, tag := range tags {
+		if tag = strings.TrimSpace(tag); tag != "" && !slices.Contains(normalized, tag) {
+			normalized = append(normalized, tag)
+		}
+	}
+	return normalized
+}
+
+type BulkRequest struct {
+	// Action is create, extend, reset, suspend, resume or delete
+	Action string `json:"action"`
+
+	// Names, Tags and Filter select the peers every action but create works on, a peer matching any of them is selected
+	Names  []string    `json:"names"`
+	Tags   []string    `json:"tags"`
+	Filter *PeerFilter `json:"filter"`
+
+	// Pattern is the name of the peers to create, {n} is replaced with Start, Start+1 and so on up to Count peers.
+	// Pad zero-pads the numbers to that many digits.
+	Pattern   string `json:"pattern"`
+	Count     int    `json:"count"`
+	Start     int    `json:"start"`
+	Pad       int    `json:"pad"`
+	Plan      string `json:"plan"`
+	Interface string `json:"interface"`
+	Role      string `json:"role"`
+
+	// Days and GB are added to the selected peers by extend
+	Days uint64 `json:"days"`
+	GB   uint64 `json:"gb"`
+
+	// Reason is stored with the peers disabled by suspend
+	Reason string `json:"reason"`
+}
+
+type BulkResult struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type BulkResponse struct {
+	Results   []BulkResult `json:"results"`
+	Succeeded int          `json:"succeeded"`
+	Failed    int          `json:"failed"`
+	// Synced lists the interfaces whose config was applied to the device
+	Synced []string `json:"synced"`
+}
+
+// bulkBatch collects the interfaces whose config files changed so each is synced once
+type bulkBatch struct {
+	changed []*Interface
+	// pending holds the peers waiting for their interface's sync, with what to record once it is applied
+	pending map[*Interface][]func(err error)
+}
+
+func (b *bulkBatch) changedInterface(iface *Interface, after func(err error)) {
+	if !slices.Contains(b.changed, iface) {
+		b.changed = append(b.changed, iface)
+	}
+	b.pending[iface] = append(b.pending[iface], after)
+}
+
+// sync applies every changed interface and runs what waited for it with the interface's result
+func (b *bulkBatch) sync() []string {
+	synced := []string{}
+	for _, iface := range b.changed {
+		err := iface.Sync()
+		if err != nil {
+			slog.Error("could not apply bulk changes", "interface", iface.Name, "error", err)
+		} else {
+			synced = append(synced, iface.Name)
+		}
+		for _, after := range b.pending[iface] {
+			after(err)
+		}
+	}
+	return synced
+}
+
+// enforce cuts off or revives the peer in its interface's config file when an action changed whether it may connect,
+// so the change goes out with the batch's sync instead of one sync per peer in the next update
+func (b *bulkBatch) enforce(p *Peer) error {
+	now := uint64(time.Now().Unix())
+	suspend := peerCutOff(p)
+	revive := !p.Disabled && p.ExpiresAt > now && p.TotalUsage < p.AllowedUsage
+	switch {
+	case suspend && !p.Suspended:
+		iface, err := suspendPeerConfig(p)
+		if err != nil {
+			return err
+		}
+		b.changedInterface(iface, func(err error) {
+			if err == nil {
+				setPeerSuspended(p, true)
+			}
+		})
+	case revive && p.Suspended:
+		iface, err := revivePeerConfig(p)
+		if err != nil {
+			return err
+		}
+		b.changedInterface(iface, func(err error) {
+			if err == nil {
+				setPeerSuspended(p, false)
+			}
+		})
+	}
+	return nil
+}
+
+// bulkNames expands the create pattern into the names of the peers to create
+func bulkNames(req *BulkRequest) ([]string, error) {
+	if !strings.Contains(req.Pattern, "{n}") {
+		return nil, errors.New("pattern must contain {n}")
+	}
+	if req.Count < 1 || req.Count > maxBulkItems {
+		return nil, fmt.Errorf("count must be between 1 and %d", maxBulkItems)
+	}
+	if req.Start < 0 || req.Pad < 0 {
+		return nil, errors.New("start and pad can't be negative")
+	}
+	names := make([]string, req.Count)
+	for i := range names {
+		n := strconv.Itoa(req.Start + i)
+		if len(n) < req.Pad {
+			n = strings.Repeat("0", req.Pad-len(n)) + n
+		}
+		names[i] = strings.ReplaceAll(req.Pattern, "{n}", n)
+	}
+	return names, nil
+}
+
+// selectBulkPeers returns the peers selected by names, tags and filter that client may manage, sorted by name.
+// Listed names that can't be used are returned as failed results.
+func selectBulkPeers(client *Peer, req *BulkRequest) ([]*Peer, []BulkResult, error) {
+	if len(req.Names) == 0 && len(req.Tags) == 0 && req.Filter == nil {
+		return nil, nil, errors.New("select peers with names, tags or filter")
+	}
+	if req.Filter != nil {
+		if req.Filter.empty() {
+			return nil, nil, errors.New("filter has no conditions")
+		}
+		if err := req.Filter.validate(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	selected := map[string]*Peer{}
+	var failed []BulkResult
+	for _, name := range req.Names {
+		p := findPeerByName(name)
+		switch {
+		case p == nil:
+			failed = append(failed, BulkResult{Name: name, Error: "peer not found"})
+		case !canManage(client, name):
+			failed = append(failed, BulkResult{Name: name, Error: "forbidden"})
+		default:
+			selected[p.Name] = p
+		}
+	}
+	tags := &PeerFilter{Tags: req.Tags}
+	for _, p := range config.Peers {
+		if !canManage(client, p.Name) {
+			continue
+		}
+		if len(req.Tags) > 0 && tags.matches(p) || req.Filter != nil && req.Filter.matches(p) {
+			selected[p.Name] = p
+		}
+	}
+
+	peers := make([]*Peer, 0, len(selected))
+	for _, p := range selected {
+		peers = append(peers, p)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Name < peers[j].Name })
+	if len(peers) > maxBulkItems {
+		return nil, nil, fmt.Errorf("%d peers are selected, at most %d can be changed at once", len(peers), maxBulkItems)
+	}
+	return peers, failed, nil
+}
+
+// runBulk applies one action to many peers with a single sync per interface. Invalid requests return an error,
+// everything else is reported per peer. The caller holds updateMutex until the batch is synced.
+func runBulk(client *Peer, req *BulkRequest) (*BulkResponse, error) {
+	batch := &bulkBatch{pending: map[*Interface][]func(error){}}
+	response := &BulkResponse{Results: []BulkResult{}}
+	var results []*BulkResult
+	result := func(name string) *BulkResult {
+		r := &BulkResult{Name: name, OK: true}
+		results = append(results, r)
+		return r
+	}
+	fail := func(r *BulkResult, err error) {
+		r.OK = false
+		r.Error = err.Error()
+	}
+
+	switch req.Action {
+	case "create":
+		names, err := bulkNames(req)
+		if err != nil {
+			return nil, err
+		}
+		if req.Role == "" {
+			req.Role = "user"
+		}
+		if req.Role != "user" && req.Role != "distributor" && req.Role != "admin" {
+			return nil, fmt.Errorf("unknown role %q", req.Role)
+		}
+		if client.Role != "admin" && req.Role != "user" {
+			return nil, errors.New("only admins can create peers with another role than user")
+		}
+		var plan *Plan
+		if req.Plan != "" {
+			if plan = findPlan(req.Plan); plan == nil {
+				return nil, errors.New("plan not found")
+			}
+		}
+		for _, name := range names {
+			r := result(name)
+			if !canManage(client, name) {
+				fail(r, errors.New("forbidden"))
+				continue
+			}
+			p, err := newPeer(name, req.Role, req.Interface, plan)
+			if err != nil {
+				fail(r, err)
+				continue
+			}
+			iface, err := appendPeerConfig(p)
+			if err != nil {
+				fail(r, err)
+				continue
+			}
+			batch.changedInterface(iface, func(err error) {
+				if err == nil {
+					err = storeNewPeer(p)
+				} else {
+					// take the peer out of the config file again so it doesn't reach the device with a later sync
+					if configBytes, readErr := os.ReadFile(iface.ConfigPath()); readErr == nil {
+						os.WriteFile(iface.ConfigPath(), []byte(removePeerSections(string(configBytes), map[string]bool{p.PublicKey: true})), 0644)
+					}
+				}
+				if err != nil {
+					fail(r, err)
+				}
+			})
+		}
+
+	case "extend", "reset", "suspend", "resume", "delete":
+		if req.Action == "extend" && req.Days == 0 && req.GB == 0 {
+			return nil, errors.New("extend needs days, gb or both")
+		}
+		peers, failed, err := selectBulkPeers(client, req)
+		if err != nil {
+			return nil, err
+		}
+		for i := range failed {
+			results = append(results, &failed[i])
+		}
+		for _, p := range peers {
+			p := p
+			r := result(p.Name)
+			var err error
+			switch req.Action {
+			case "extend":
+				if req.Days != 0 {
+					err = extendPeer(p, req.Days)
+				}
+				if err == nil && req.GB != 0 {
+					err = addPeerUsage(p, req.GB*gigabyte)
+				}
+			case "reset":
+				err = resetPeerUsage(p)
+			case "suspend":
+				err = setPeerDisabled(p, true, strings.TrimSpace(req.Reason), client.Name)
+			case "resume":
+				err = setPeerDisabled(p, false, "", client.Name)
+			case "delete":
+				if err := canTrashPeer(p); err != nil {
+					fail(r, err)
+					continue
+				}
+				iface, err := removePeerConfig(p)
+				if err != nil {
+					fail(r, err)
+					continue
+				}
+				batch.changedInterface(iface, func(err error) {
+					if err == nil {
+						err = trashPeer(p, client.Name)
+					}
+					if err != nil {
+						fail(r, err)
+					}
+				})
+				continue
+			}
+			if err == nil {
+				err = batch.enforce(p)
+			}
+			if err != nil {
+				fail(r, err)
+			}
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown action %q, use create, extend, reset, suspend, resume or delete", req.Action)
+	}
+
+	response.Synced = batch.sync()
+	for _, r := range results {
+		response.Results = append(response.Results, *r)
+		if r.OK {
+			response.Succeeded++
+		} else {
+			response.Failed++
+		}
+	}
+	slog.Info("ran bulk action", "action", req.Action, "actor", client.Name, "succeeded", response.Succeeded, "failed", response.Failed, "synced", response.Synced)
+	return response, nil
+}
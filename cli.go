@@ -0,0 +1,715 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const usage = `usage: wireguard-ui [command] [arguments]
+
+commands:
+  serve [dir]                       start the server, the default when no command is given
+  init                              set up the server interface and config.json
+  peers list                        list peers, or the peers in the trash with -trash
+  peers show <name>                 show a peer
+  peers add <name>                  create a peer
+  peers delete <name>               move a peer to the trash, or delete it for good with -purge
+  peers restore <name>              put a peer from the trash back on its interface
+  peers purge <name>                delete a peer in the trash for good
+  peers extend <name>               add days or gigabytes to a peer
+  peers reset <name>                reset a peer's usage
+  peers rotate <name>               give a peer new keys and send it its new config
+  peers suspend <name>              disable a peer
+  peers resume <name>               enable a disabled peer
+  peers import [file or folder]     adopt unmanaged peers of the interfaces or import another panel's peers
+  config export <name>              write a peer's client config, QR code or bundle
+  backup create                     write a backup of the config, interfaces and peers
+  backup inspect <file>             check a backup and show what it contains
+  backup restore <file>             replace the interfaces and peers with a backup's
+  doctor                            check the server's setup
+
+every command except init accepts -config, the path of the config file, or -dir,
+the folder containing config.json, and -o table|json to choose the output format.
+`
+
+// cliOptions are the flags shared by all commands that work on the store
+type cliOptions struct {
+	dir        string
+	configFile string
+	output     string
+}
+
+func (o *cliOptions) register(flags *flag.FlagSet) {
+	flags.StringVar(&o.dir, "dir", "", "folder containing config.json")
+	flags.StringVar(&o.configFile, "config", "", "path of the config file, defaults to $"+configEnvironmentPrefix+"CONFIG or config.json in the current directory")
+	flags.StringVar(&o.output, "o", "table", "output format, table or json")
+}
+
+func (o *cliOptions) configPath() string {
+	if o.configFile != "" {
+		return o.configFile
+	}
+	if o.dir != "" {
+		return filepath.Join(o.dir, "config.json")
+	}
+	return defaultConfigPath()
+}
+
+// parseFlags parses flags wherever they appear between the positional arguments and returns the positional arguments
+func parseFlags(flags *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		flags.Parse(args)
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// runCommand runs the subcommand named by args, starting the server when there is none.
+// A single argument that isn't a command is the config folder, as passed by older service files.
+func runCommand(args []string) error {
+	if len(args) == 0 {
+		return serve(defaultConfigPath())
+	}
+	switch args[0] {
+	case "serve":
+		options := cliOptions{}
+		flags := flag.NewFlagSet("serve", flag.ExitOnError)
+		options.register(flags)
+		if positional := parseFlags(flags, args[1:]); len(positional) > 0 {
+			options.dir = positional[0]
+		}
+		return serve(options.configPath())
+	case "init":
+		return runSetup(args[1:])
+	case "peers":
+		return runPeersCommand(args[1:])
+	case "config":
+		return runConfigCommand(args[1:])
+	case "backup":
+		return runBackupCommand(args[1:])
+	case "doctor":
+		return runDoctor(args[1:])
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+		return nil
+	}
+	if strings.HasPrefix(args[0], "-") || len(args) > 1 {
+		fmt.Print(usage)
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+	return serve(filepath.Join(args[0], "config.json"))
+}
+
+// openStore loads the config and peers for a command without creating the first admin or starting any background work
+func openStore(options cliOptions) error {
+	if options.output != "table" && options.output != "json" {
+		return fmt.Errorf("unknown output format %q", options.output)
+	}
+	if err := loadConfig(options.configPath()); err != nil {
+		return err
+	}
+	configFile = options.configPath()
+	if err := connectDatabase(); err != nil {
+		return err
+	}
+	return loadPeers()
+}
+
+// stateLockFile is the file in config.Path that a running server keeps locked. Commands that change peers lock it too,
+// so they don't change the interfaces' config files and the database under a server or another command.
+const stateLockFile = "wireguard-ui.lock"
+
+var errStateLocked = errors.New("a running server or another command holds " + stateLockFile + ", change peers through the server's api or stop it first")
+
+// stateLock keeps the locked file open, the lock is released when the process exits
+var stateLock *os.File
+
+// lockState locks the state lock file of config.Path, or returns errStateLocked without waiting if it is taken
+func lockState() error {
+	f, err := os.OpenFile(filepath.Join(config.Path, stateLockFile), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return errStateLocked
+		}
+		return err
+	}
+	stateLock = f
+	return nil
+}
+
+func peerStatus(p *Peer) string {
+	switch {
+	case p.DeletedAt != 0:
+		return "deleted"
+	case p.Disabled:
+		return "disabled"
+	case p.Suspended:
+		return "suspended"
+	}
+	return "active"
+}
+
+func printJSON(v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
+
+func printPeers(output string, peers []*Peer) error {
+	if output == "json" {
+		return printJSON(peers)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tROLE\tINTERFACE\tADDRESS\tEXPIRES\tUSAGE\tSTATUS")
+	for _, p := range peers {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%.2f/%.2f GB\t%s\n",
+			p.Name,
+			p.Role,
+			p.Interface,
+			p.Address,
+			time.Unix(int64(p.ExpiresAt), 0).Format("2006-01-02 15:04"),
+			float64(p.TotalUsage)/gigabyte,
+			float64(p.AllowedUsage)/gigabyte,
+			peerStatus(p))
+	}
+	return w.Flush()
+}
+
+func runPeersCommand(args []string) error {
+	if len(args) == 0 {
+		fmt.Print(usage)
+		return errors.New("missing peers command")
+	}
+	command := args[0]
+	if !slices.Contains([]string{"list", "show", "add", "delete", "restore", "purge", "extend", "reset", "rotate", "suspend", "resume", "import"}, command) {
+		fmt.Print(usage)
+		return fmt.Errorf("unknown peers command %q", command)
+	}
+	options := cliOptions{}
+	flags := flag.NewFlagSet("peers "+command, flag.ExitOnError)
+	options.register(flags)
+	role := flags.String("role", "user", "role of the new or imported peers, user, distributor or admin")
+	interfaceName := flags.String("interface", "", "interface of the new or imported peers, or the interface to list peers of")
+	planName := flags.String("plan", "", "plan the new or imported peers are created from")
+	email := flags.String("email", "", "email address of the new peer")
+	days := flags.Uint64("days", 0, "days to add to the peer's expiry, or that imported peers without an expiry get")
+	gigabytes := flags.Uint64("gb", 0, "gigabytes to add to the peer's allowed usage, or that imported peers without a limit get")
+	from := flags.String("from", importFromInterface, "what to import, interface, wg-easy, conf or csv")
+	prefix := flags.String("prefix", "imported", "start of the placeholder names of imported peers without a name")
+	dryRun := flags.Bool("dry-run", false, "show what would be imported without changing anything")
+	reason := flags.String("reason", "", "why the peer is suspended")
+	trash := flags.Bool("trash", false, "list the peers in the trash")
+	purge := flags.Bool("purge", false, "delete the peer for good instead of moving it to the trash")
+	keypair := flags.Bool("keypair", false, "replace only the peer's keypair, both keys are replaced when neither -keypair nor -psk is set")
+	psk := flags.Bool("psk", false, "replace only the peer's preshared key")
+	grace := flags.Int("grace", 0, "minutes the old keypair stays valid, on the old address while the new keypair gets another")
+	notify := flags.Bool("notify", true, "email the new config to the peer")
+	positional := parseFlags(flags, args[1:])
+
+	if command == "import" {
+		return runPeersImport(options, *from, positional, ImportOptions{
+			Interface:    *interfaceName,
+			Days:         *days,
+			AllowedUsage: *gigabytes * gigabyte,
+			Role:         *role,
+			Prefix:       *prefix,
+			DryRun:       *dryRun,
+		}, *planName)
+	}
+
+	if command == "list" {
+		if err := openStore(options); err != nil {
+			return err
+		}
+		peers := []*Peer{}
+		listed := config.Peers
+		if *trash {
+			listed = config.Trash
+		}
+		for _, p := range listed {
+			if *interfaceName == "" || p.Interface == *interfaceName {
+				peers = append(peers, p)
+			}
+		}
+		sort.Slice(peers, func(i, j int) bool { return peers[i].Name < peers[j].Name })
+		return printPeers(options.output, peers)
+	}
+
+	if len(positional) != 1 {
+		return fmt.Errorf("usage: wireguard-ui peers %s <name>", command)
+	}
+	name := positional[0]
+	if err := openStore(options); err != nil {
+		return err
+	}
+	if command != "show" {
+		if err := lockState(); err != nil {
+			return err
+		}
+	}
+	// webhooks are delivered in the background, don't exit before they are sent
+	defer pendingWebhooks.Wait()
+
+	if command == "add" {
+		if *role != "user" && *role != "distributor" && *role != "admin" {
+			return fmt.Errorf("unknown role %q", *role)
+		}
+		var plan *Plan
+		if *planName != "" {
+			if plan = findPlan(*planName); plan == nil {
+				return errors.New("plan not found")
+			}
+		}
+		address, err := validateEmail(*email)
+		if err != nil {
+			return err
+		}
+		p, err := createPeer(name, *role, *interfaceName, plan)
+		if err != nil {
+			return err
+		}
+		if address != "" {
+			if err = setPeerEmail(p, address); err != nil {
+				return err
+			}
+			if config.SMTP != nil && config.SMTP.SendConfigOnCreate {
+				if err = sendPeerConfigEmail(p); err != nil {
+					fmt.Fprintln(os.Stderr, err)
+				}
+			}
+		}
+		return printPeers(options.output, []*Peer{p})
+	}
+
+	if command == "delete" {
+		if err := deletePeer(name, "cli", *purge); err != nil {
+			return err
+		}
+		if options.output == "json" {
+			return printJSON(map[string]interface{}{"deleted": name})
+		}
+		fmt.Printf("deleted %s\n", name)
+		return nil
+	}
+
+	if command == "restore" {
+		p, err := restorePeer(name)
+		if err != nil {
+			return err
+		}
+		return printPeers(options.output, []*Peer{p})
+	}
+
+	if command == "purge" {
+		p := findTrashedPeer(name)
+		if p == nil {
+			return errors.New("peer not found in trash")
+		}
+		if err := purgePeer(p); err != nil {
+			return err
+		}
+		if options.output == "json" {
+			return printJSON(map[string]interface{}{"purged": name})
+		}
+		fmt.Printf("purged %s\n", name)
+		return nil
+	}
+
+	p := findPeerByName(name)
+	if p == nil {
+		return errors.New("peer not found")
+	}
+	var err error
+	switch command {
+	case "show":
+	case "extend":
+		if *days == 0 && *gigabytes == 0 {
+			return errors.New("pass -days, -gb or both")
+		}
+		if *days != 0 {
+			err = extendPeer(p, *days)
+		}
+		if err == nil && *gigabytes != 0 {
+			err = addPeerUsage(p, *gigabytes*gigabyte)
+		}
+	case "reset":
+		err = resetPeerUsage(p)
+	case "rotate":
+		// notify here, the process would exit before a notification in the background is sent
+		background := false
+		err = rotatePeerKeys(p, &RotateRequest{Keypair: *keypair, PresharedKey: *psk, GraceMinutes: *grace, Notify: &background})
+		if err == nil && p.RetiredKey != nil {
+			fmt.Fprintf(os.Stderr, "%s moved from %s to %s, its old keypair keeps %s for %d minutes\n", name, p.RetiredKey.Address, p.Address, p.RetiredKey.Address, *grace)
+		}
+		if err == nil && *notify {
+			notifyRotatedPeer(p, time.Duration(*grace)*time.Minute)
+		}
+	case "suspend":
+		err = setPeerDisabled(p, true, strings.TrimSpace(*reason), "cli")
+	case "resume":
+		err = setPeerDisabled(p, false, "", "cli")
+	}
+	if err != nil {
+		return err
+	}
+	return printPeers(options.output, []*Peer{p})
+}
+
+// runPeersImport reads the peers of the source at the positional path, a file or a folder of .conf files, and imports them
+func runPeersImport(options cliOptions, from string, positional []string, importOptions ImportOptions, planName string) error {
+	files := map[string][]byte{}
+	if from != importFromInterface {
+		if len(positional) != 1 {
+			return fmt.Errorf("usage: wireguard-ui peers import -from %s <file or folder>", from)
+		}
+		paths := []string{positional[0]}
+		if info, err := os.Stat(positional[0]); err == nil && info.IsDir() {
+			if paths, err = filepath.Glob(filepath.Join(positional[0], "*.conf")); err != nil {
+				return err
+			}
+		}
+		for _, path := range paths {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			files[filepath.Base(path)] = data
+		}
+	} else if len(positional) != 0 {
+		return errors.New("usage: wireguard-ui peers import [-interface name], peers on the interfaces need no file")
+	}
+	if err := openStore(options); err != nil {
+		return err
+	}
+	if !importOptions.DryRun {
+		if err := lockState(); err != nil {
+			return err
+		}
+	}
+	defer pendingWebhooks.Wait()
+	if planName != "" {
+		if importOptions.Plan = findPlan(planName); importOptions.Plan == nil {
+			return errors.New("plan not found")
+		}
+	}
+	candidates, err := importCandidates(from, files, importOptions.Interface)
+	if err != nil {
+		return err
+	}
+	results, err := importPeers(candidates, from, importOptions)
+	if err != nil {
+		return err
+	}
+	if options.output == "json" {
+		return printJSON(results)
+	}
+	counts := map[string]int{}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSTATUS\tINTERFACE\tADDRESS\tPUBLIC KEY\tNOTE")
+	for _, r := range results {
+		counts[r.Status]++
+		note := r.Reason
+		if r.NewPresharedKey {
+			note = "new preshared key, send the peer its new config"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", r.Name, r.Status, r.Interface, r.Address, r.PublicKey, note)
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	if importOptions.DryRun {
+		fmt.Printf("would import %d peers, skipped %d, failed %d\n", counts["ok"], counts["skipped"], counts["failed"])
+		return nil
+	}
+	fmt.Printf("imported %d peers, skipped %d, failed %d\n", counts["imported"], counts["skipped"], counts["failed"])
+	return nil
+}
+
+func runConfigCommand(args []string) error {
+	if len(args) == 0 || args[0] != "export" {
+		fmt.Print(usage)
+		return errors.New("missing config command")
+	}
+	options := cliOptions{}
+	flags := flag.NewFlagSet("config export", flag.ExitOnError)
+	options.register(flags)
+	format := flags.String("format", "conf", "conf, png, svg or zip")
+	out := flags.String("out", "", "file to write to, defaults to stdout")
+	size := flags.Int("size", defaultQRCodeSize, "size of png QR codes in pixels")
+	positional := parseFlags(flags, args[1:])
+	if len(positional) != 1 {
+		return errors.New("usage: wireguard-ui config export <name>")
+	}
+	if err := openStore(options); err != nil {
+		return err
+	}
+	p := findPeerByName(positional[0])
+	if p == nil {
+		return errors.New("peer not found")
+	}
+
+	var data []byte
+	switch *format {
+	case "conf":
+		data = []byte(generateConfig(p))
+	case "png":
+		qr, err := peerQRCodePNG(p, *size)
+		if err != nil {
+			return err
+		}
+		data = qr
+	case "svg":
+		qr, err := peerQRCodeSVG(p)
+		if err != nil {
+			return err
+		}
+		data = []byte(qr)
+	case "zip":
+		var buf bytes.Buffer
+		archive := zip.NewWriter(&buf)
+		if err := writePeerBundle(archive, "", p); err != nil {
+			return err
+		}
+		if err := archive.Close(); err != nil {
+			return err
+		}
+		data = buf.Bytes()
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	if *out == "" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(*out, data, 0600)
+}
+
+func runBackupCommand(args []string) error {
+	if len(args) == 0 || !slices.Contains([]string{"create", "inspect", "restore"}, args[0]) {
+		fmt.Print(usage)
+		return errors.New("missing backup command")
+	}
+	command := args[0]
+	options := cliOptions{}
+	flags := flag.NewFlagSet("backup "+command, flag.ExitOnError)
+	options.register(flags)
+	out := flags.String("out", "", "file to write the backup to, defaults to a dated file in the current directory")
+	passphraseFile := flags.String("passphrase-file", "", "file containing the passphrase, defaults to $"+configEnvironmentPrefix+"BACKUP_PASSPHRASE or backup.passphrase")
+	withConfig := flags.Bool("with-config", false, "restore config.json too, to the path given by -config or -dir")
+	positional := parseFlags(flags, args[1:])
+
+	if command == "create" {
+		if err := openStore(options); err != nil {
+			return err
+		}
+		passphrase, err := backupPassphrase(*passphraseFile)
+		if err != nil {
+			return err
+		}
+		if *out == "" {
+			*out = backupFilePrefix + time.Now().UTC().Format("20060102-150405") + ".zip"
+			if passphrase != "" {
+				*out += ".enc"
+			}
+		}
+		var buf bytes.Buffer
+		manifest, err := writeBackup(&buf, passphrase)
+		if err != nil {
+			return err
+		}
+		if err = os.WriteFile(*out, buf.Bytes(), 0600); err != nil {
+			return err
+		}
+		if options.output == "json" {
+			return printJSON(map[string]interface{}{"file": *out, "encrypted": passphrase != "", "manifest": manifest})
+		}
+		fmt.Printf("wrote %s with %d peers and interfaces %s\n", *out, manifest.Peers, strings.Join(manifest.Interfaces, ", "))
+		if passphrase == "" {
+			fmt.Println("the backup isn't encrypted and contains every peer's private key, keep it safe")
+		}
+		return nil
+	}
+
+	if len(positional) != 1 {
+		return fmt.Errorf("usage: wireguard-ui backup %s <file>", command)
+	}
+	// restoring into the current config needs the store before the backup is read, so its passphrase can be used
+	if command == "restore" && !*withConfig {
+		if err := openStore(options); err != nil {
+			return err
+		}
+		if err := lockState(); err != nil {
+			return err
+		}
+	}
+	// a server may be running with the config being replaced, there is none if it can't be loaded
+	if command == "restore" && *withConfig && loadConfig(options.configPath()) == nil {
+		if err := lockState(); err != nil {
+			return err
+		}
+	}
+	data, err := os.ReadFile(positional[0])
+	if err != nil {
+		return err
+	}
+	passphrase, err := backupPassphrase(*passphraseFile)
+	if err != nil {
+		return err
+	}
+	b, err := readBackup(data, passphrase)
+	if err != nil {
+		return err
+	}
+	if command == "inspect" {
+		if options.output == "json" {
+			return printJSON(b.Manifest)
+		}
+		fmt.Printf("version %d backup of %s from %s\n", b.Manifest.Version, b.Manifest.Hostname, time.Unix(b.Manifest.CreatedAt, 0).Format("2006-01-02 15:04"))
+		fmt.Printf("%d peers, interfaces %s, config.json included: %t\n", b.Manifest.Peers, strings.Join(b.Manifest.Interfaces, ", "), b.Manifest.Config)
+		return nil
+	}
+
+	configPath := ""
+	if *withConfig {
+		configPath = options.configPath()
+	}
+	if err = restoreFiles(b, configPath); err != nil {
+		return err
+	}
+	if *withConfig {
+		if err = openStore(options); err != nil {
+			return err
+		}
+	}
+	if err = restorePeers(b); err != nil {
+		return err
+	}
+	if err = applyRestoredInterfaces(b); err != nil {
+		return err
+	}
+	if options.output == "json" {
+		return printJSON(RestoreResult{Manifest: b.Manifest, Interfaces: b.Manifest.Interfaces, Peers: len(b.Peers), Config: *withConfig})
+	}
+	fmt.Printf("restored %d peers and interfaces %s\n", len(b.Peers), strings.Join(b.Manifest.Interfaces, ", "))
+	return nil
+}
+
+// DoctorCheck is the result of one of the doctor command's checks
+type DoctorCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail"`
+}
+
+// runDoctor checks everything the server needs to start and reports all problems instead of stopping at the first
+func runDoctor(args []string) error {
+	options := cliOptions{}
+	flags := flag.NewFlagSet("doctor", flag.ExitOnError)
+	options.register(flags)
+	parseFlags(flags, args)
+
+	var checks []DoctorCheck
+	check := func(name string, err error, detail string) bool {
+		if err != nil {
+			detail = strings.ReplaceAll(strings.Replace(err.Error(), ":\n", ": ", 1), "\n", "; ")
+		}
+		checks = append(checks, DoctorCheck{Name: name, OK: err == nil, Detail: detail})
+		return err == nil
+	}
+
+	for _, binary := range []string{"wg", "wg-quick"} {
+		path, err := exec.LookPath(binary)
+		check(binary, err, path)
+	}
+	if check("config", loadConfig(options.configPath()), options.configPath()) {
+		for _, iface := range config.Interfaces {
+			lines, err := iface.Dump()
+			check("interface "+iface.Name, err, fmt.Sprintf("up with %d peers", len(lines)))
+		}
+		script := filepath.Join(config.Path, "scripts", "replace-string.sh")
+		_, err := os.Stat(script)
+		check("scripts", err, script)
+		frontend := filepath.Join(config.Path, "public", "build")
+		_, err = os.Stat(frontend)
+		check("frontend", err, frontend)
+
+		err = connectDatabase()
+		if err == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			err = config.Collection.Database().Client().Ping(ctx, nil)
+			cancel()
+		}
+		if check("mongodb", err, config.DBName+"."+config.CollectionName) {
+			count, err := config.Collection.CountDocuments(context.TODO(), bson.D{})
+			check("peers", err, fmt.Sprintf("%d peers", count))
+		}
+
+		if config.TelegramBotToken == "" {
+			check("telegram", nil, "no bot token, bot disabled")
+		} else {
+			bot, err := tgbotapi.NewBotAPI(config.TelegramBotToken)
+			detail := ""
+			if err == nil {
+				detail = "@" + bot.Self.UserName
+			}
+			check("telegram", err, detail)
+		}
+	}
+
+	failed := 0
+	for _, c := range checks {
+		if !c.OK {
+			failed++
+		}
+	}
+	if options.output == "json" {
+		if err := printJSON(checks); err != nil {
+			return err
+		}
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, c := range checks {
+			status := "ok"
+			if !c.OK {
+				status = "FAIL"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", status, c.Name, c.Detail)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(checks))
+	}
+	return nil
+}
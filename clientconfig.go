@@ -0,0 +1,234 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"strings"
+	"text/template"
+)
+
+const defaultClientConfigTemplate = `[Interface]
+PrivateKey = {{.PrivateKey}}
+Address = {{.Address}}
+{{- if .DNS}}
+DNS = {{.DNS}}
+{{- end}}
+{{- if .MTU}}
+MTU = {{.MTU}}
+{{- end}}
+[Peer]
+PublicKey = {{.ServerPublicKey}}
+PresharedKey = {{.PresharedKey}}
+AllowedIPs = {{.AllowedIPs}}
+Endpoint = {{.Endpoint}}
+{{- if .PersistentKeepalive}}
+PersistentKeepalive = {{.PersistentKeepalive}}
+{{- end}}
+`
+
+// unknownPrivateKey stands in for the private key in configs of peers whose key isn't known
+const unknownPrivateKey = "<the private key already on the client>"
+
+var clientConfigTemplate = template.Must(template.New("client").Parse(defaultClientConfigTemplate))
+
+// ClientSettings overrides what goes into a peer's client config, empty fields fall back to the group's settings and then to the server defaults
+type ClientSettings struct {
+	// AllowedIPs is a comma separated list of CIDRs routed through the tunnel, defaults to 0.0.0.0/0
+	AllowedIPs string `bson:"allowedIPs,omitempty" json:"allowedIPs,omitempty"`
+	// ExcludedIPs is a comma separated list of CIDRs removed from AllowedIPs, the rest is expanded into the complementary CIDR set
+	ExcludedIPs         string `bson:"excludedIPs,omitempty" json:"excludedIPs,omitempty"`
+	DNS                 string `bson:"dns,omitempty" json:"dns,omitempty"`
+	MTU                 int    `bson:"mtu,omitempty" json:"mtu,omitempty"`
+	PersistentKeepalive int    `bson:"persistentKeepalive,omitempty" json:"persistentKeepalive,omitempty"`
+	Endpoint            string `bson:"endpoint,omitempty" json:"endpoint,omitempty"`
+}
+
+// ClientConfigData is what client config templates are executed with
+type ClientConfigData struct {
+	Peer                *Peer
+	PrivateKey          string
+	PresharedKey        string
+	Address             string
+	DNS                 string
+	MTU                 int
+	ServerPublicKey     string
+	AllowedIPs          string
+	Endpoint            string
+	PersistentKeepalive int
+}
+
+func parseClientConfigTemplate(path string) (*template.Template, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return template.New("client").Parse(string(bytes))
+}
+
+// loadClientConfigTemplate replaces the built-in client config template with the one at path
+func loadClientConfigTemplate(path string) error {
+	t, err := parseClientConfigTemplate(path)
+	if err != nil {
+		return err
+	}
+	clientConfigTemplate = t
+	return nil
+}
+
+// merge returns s with its empty fields filled from fallback
+func (s ClientSettings) merge(fallback ClientSettings) ClientSettings {
+	if s.AllowedIPs == "" {
+		s.AllowedIPs = fallback.AllowedIPs
+	}
+	if s.ExcludedIPs == "" {
+		s.ExcludedIPs = fallback.ExcludedIPs
+	}
+	if s.DNS == "" {
+		s.DNS = fallback.DNS
+	}
+	if s.MTU == 0 {
+		s.MTU = fallback.MTU
+	}
+	if s.PersistentKeepalive == 0 {
+		s.PersistentKeepalive = fallback.PersistentKeepalive
+	}
+	if s.Endpoint == "" {
+		s.Endpoint = fallback.Endpoint
+	}
+	return s
+}
+
+func (s ClientSettings) validate() error {
+	if _, err := parsePrefixes(s.AllowedIPs); err != nil {
+		return err
+	}
+	if _, err := parsePrefixes(s.ExcludedIPs); err != nil {
+		return err
+	}
+	for _, dns := range splitList(s.DNS) {
+		if _, err := netip.ParseAddr(dns); err != nil {
+			return fmt.Errorf("invalid dns server %q", dns)
+		}
+	}
+	if s.MTU != 0 && (s.MTU < 576 || s.MTU > 65535) {
+		return errors.New("mtu must be between 576 and 65535")
+	}
+	if s.PersistentKeepalive < 0 || s.PersistentKeepalive > 65535 {
+		return errors.New("persistent keepalive must be between 0 and 65535")
+	}
+	return nil
+}
+
+// peerClientSettings resolves the settings used for the peer's client config
+func peerClientSettings(peer *Peer) ClientSettings {
+	var settings ClientSettings
+	if peer.ClientSettings != nil {
+		settings = *peer.ClientSettings
+	}
+	settings = settings.merge(config.GroupClientSettings[groupOf(peer.Name)])
+	iface := peerInterface(peer)
+	return settings.merge(ClientSettings{
+		AllowedIPs: "0.0.0.0/0",
+		DNS:        iface.DNSServers,
+		Endpoint:   iface.Endpoint,
+	})
+}
+
+func generateConfig(peer *Peer) string {
+	settings := peerClientSettings(peer)
+	allowedIPs := settings.AllowedIPs
+	if settings.ExcludedIPs != "" {
+		allowed, _ := parsePrefixes(settings.AllowedIPs)
+		excluded, _ := parsePrefixes(settings.ExcludedIPs)
+		var cidrs []string
+		for _, p := range excludePrefixes(allowed, excluded) {
+			cidrs = append(cidrs, p.String())
+		}
+		allowedIPs = strings.Join(cidrs, ", ")
+	}
+
+	privateKey := peer.PrivateKey
+	if privateKey == "" {
+		// peers adopted from an interface keep their key, only their client has it
+		privateKey = unknownPrivateKey
+	}
+	data := ClientConfigData{
+		Peer:                peer,
+		PrivateKey:          privateKey,
+		PresharedKey:        peer.PresharedKey,
+		Address:             fmt.Sprintf("%s/%s", peer.Address, strings.Split(peerInterface(peer).NetworkAddress, "/")[1]),
+		DNS:                 settings.DNS,
+		MTU:                 settings.MTU,
+		ServerPublicKey:     peerInterface(peer).PublicKey,
+		AllowedIPs:          allowedIPs,
+		Endpoint:            settings.Endpoint,
+		PersistentKeepalive: settings.PersistentKeepalive,
+	}
+	var b strings.Builder
+	if err := clientConfigTemplate.Execute(&b, data); err != nil {
+		slog.Error("client config template failed, using the built-in one", peerLog(peer), "error", err)
+		b.Reset()
+		template.Must(template.New("client").Parse(defaultClientConfigTemplate)).Execute(&b, data)
+	}
+	return b.String()
+}
+
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func parsePrefixes(list string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, item := range splitList(list) {
+		p, err := netip.ParsePrefix(item)
+		if err != nil {
+			// accept single addresses as host routes
+			addr, addrErr := netip.ParseAddr(item)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid cidr %q", item)
+			}
+			p = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// excludePrefixes returns the smallest set of prefixes covering allowed but none of excluded
+func excludePrefixes(allowed []netip.Prefix, excluded []netip.Prefix) []netip.Prefix {
+	result := allowed
+	for _, e := range excluded {
+		var next []netip.Prefix
+		for _, p := range result {
+			next = append(next, subtractPrefix(p, e)...)
+		}
+		result = next
+	}
+	return result
+}
+
+func subtractPrefix(p netip.Prefix, e netip.Prefix) []netip.Prefix {
+	if p.Addr().Is4() != e.Addr().Is4() || !p.Overlaps(e) {
+		return []netip.Prefix{p}
+	}
+	if e.Bits() <= p.Bits() {
+		// e covers all of p
+		return nil
+	}
+	// split p in halves and keep the half that doesn't contain e whole
+	low := netip.PrefixFrom(p.Addr(), p.Bits()+1)
+	bytes := p.Addr().AsSlice()
+	bytes[p.Bits()/8] |= 0x80 >> (p.Bits() % 8)
+	highAddr, _ := netip.AddrFromSlice(bytes)
+	high := netip.PrefixFrom(highAddr, p.Bits()+1)
+	return append(subtractPrefix(low, e), subtractPrefix(high, e)...)
+}
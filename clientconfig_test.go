@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func mustParsePrefixes(t *testing.T, list string) []netip.Prefix {
+	t.Helper()
+	prefixes, err := parsePrefixes(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return prefixes
+}
+
+func TestExcludePrefixes(t *testing.T) {
+	tests := []struct {
+		name     string
+		allowed  string
+		excluded string
+		want     string
+	}{
+		{
+			name:     "ipv4",
+			allowed:  "0.0.0.0/0",
+			excluded: "10.0.0.0/8",
+			want:     "0.0.0.0/5, 8.0.0.0/7, 11.0.0.0/8, 12.0.0.0/6, 16.0.0.0/4, 32.0.0.0/3, 64.0.0.0/2, 128.0.0.0/1",
+		},
+		{
+			name:     "ipv6",
+			allowed:  "::/0",
+			excluded: "fd00::/8",
+			want:     "::/1, 8000::/2, c000::/3, e000::/4, f000::/5, f800::/6, fc00::/8, fe00::/7",
+		},
+		{
+			name:     "both families, each excluded from its own",
+			allowed:  "10.0.0.0/24, fd00::/126",
+			excluded: "10.0.0.0/25, fd00::/127",
+			want:     "10.0.0.128/25, fd00::2/127",
+		},
+		{
+			name:     "several exclusions",
+			allowed:  "10.0.0.0/24",
+			excluded: "10.0.0.0/26, 10.0.0.128/25",
+			want:     "10.0.0.64/26",
+		},
+		{
+			name:     "exclusion covering the whole range",
+			allowed:  "10.0.0.0/24",
+			excluded: "10.0.0.0/16",
+			want:     "",
+		},
+		{
+			name:     "exclusion equal to the range",
+			allowed:  "10.0.0.0/24, 192.168.1.0/24",
+			excluded: "10.0.0.0/24",
+			want:     "192.168.1.0/24",
+		},
+		{
+			name:     "exclusions that don't overlap",
+			allowed:  "10.0.0.0/24",
+			excluded: "192.168.0.0/16, 10.0.1.0/24, fd00::/8",
+			want:     "10.0.0.0/24",
+		},
+		{
+			name:     "no exclusions",
+			allowed:  "0.0.0.0/0, ::/0",
+			excluded: "",
+			want:     "0.0.0.0/0, ::/0",
+		},
+	}
+	for _, test := range tests {
+		got := excludePrefixes(mustParsePrefixes(t, test.allowed), mustParsePrefixes(t, test.excluded))
+		if want := mustParsePrefixes(t, test.want); !slices.Equal(got, want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, want)
+		}
+	}
+}
+
+func TestSubtractPrefixKeepsTheRest(t *testing.T) {
+	// the pieces left of a /24 without one address are the 255 other addresses, none of them twice
+	p, e := netip.MustParsePrefix("192.168.1.0/24"), netip.MustParsePrefix("192.168.1.77/32")
+	pieces := subtractPrefix(p, e)
+	if len(pieces) != 8 {
+		t.Errorf("got %d prefixes, want 8", len(pieces))
+	}
+	covered := 0
+	for _, piece := range pieces {
+		if piece.Overlaps(e) || !p.Overlaps(piece) {
+			t.Errorf("%s overlaps the excluded address or lies outside %s", piece, p)
+		}
+		covered += 1 << (32 - piece.Bits())
+	}
+	if covered != 255 {
+		t.Errorf("the prefixes cover %d addresses, want 255", covered)
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// configEnvironmentPrefix is prepended to the names of environment variables that override config.json
+const configEnvironmentPrefix = "WIREGUARD_UI_"
+
+// configEnvironment maps environment variables to the config field they override, mostly secrets that shouldn't live in config.json
+func configEnvironment(c *Config) map[string]*string {
+	env := map[string]*string{
+		"MONGO_URI":                &c.MongoURI,
+		"DB_NAME":                  &c.DBName,
+		"COLLECTION_NAME":          &c.CollectionName,
+		"TELEGRAM_BOT_TOKEN":       &c.TelegramBotToken,
+		"TELEGRAM_OPERATOR_SECRET": &c.TelegramOperatorSecret,
+		"AGENT_TOKEN":              &c.AgentToken,
+		"LOG_LEVEL":                &c.Log.Level,
+		"LOG_FORMAT":               &c.Log.Format,
+		"BACKUP_PASSPHRASE":        &c.Backup.Passphrase,
+	}
+	if c.SMTP != nil {
+		env["SMTP_PASSWORD"] = &c.SMTP.Password
+	}
+	return env
+}
+
+// defaultConfigPath is config.json in the current directory unless WIREGUARD_UI_CONFIG names another file
+func defaultConfigPath() string {
+	if path := os.Getenv(configEnvironmentPrefix + "CONFIG"); path != "" {
+		return path
+	}
+	return "config.json"
+}
+
+// readConfig reads the config file at path, applies environment overrides and defaults, and validates the result.
+// All problems found are returned together.
+func readConfig(path string) (*Config, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Config{}
+	if err = json.Unmarshal(bytes, c); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	for name, field := range configEnvironment(c) {
+		if value, ok := os.LookupEnv(configEnvironmentPrefix + name); ok {
+			*field = value
+		}
+	}
+	if err = c.setDefaults(path); err != nil {
+		return nil, err
+	}
+	if err = c.validate(); err != nil {
+		return nil, fmt.Errorf("%s has problems:\n%w", path, err)
+	}
+	return c, nil
+}
+
+func (c *Config) setDefaults(path string) error {
+	if c.DBName == "" {
+		c.DBName = "wgdb"
+	}
+	if c.CollectionName == "" {
+		c.CollectionName = "peers"
+	}
+	if c.WebhookDeliveriesCollectionName == "" {
+		c.WebhookDeliveriesCollectionName = "webhookDeliveries"
+	}
+	if c.Path == "" {
+		// the wireguard-ui folder usually holds config.json
+		dir, err := filepath.Abs(filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		c.Path = dir
+	}
+	c.HTTP.setDefaults(c.Path)
+	c.Log.setDefaults()
+	c.Backup.setDefaults()
+	if c.MaxUpdateAge == 0 {
+		c.MaxUpdateAge = 10
+	}
+	if c.ExpiryNoticeDays == 0 {
+		c.ExpiryNoticeDays = 3
+	}
+	if c.TrashDays == 0 {
+		c.TrashDays = 30
+	}
+	if c.UsageNoticeBytes == 0 {
+		c.UsageNoticeBytes = 3 * gigabyte
+	}
+	if c.DNSServers == "" {
+		c.DNSServers = "1.1.1.1,8.8.8.8"
+	}
+	if len(c.Interfaces) == 0 {
+		if c.InterfaceName == "" {
+			c.InterfaceName = "wg0"
+		}
+		c.Interfaces = []*Interface{{
+			Name:           c.InterfaceName,
+			Endpoint:       c.ServerEndpoint,
+			PublicKey:      c.ServerPublicKey,
+			NetworkAddress: c.ServerNetworkAddress,
+		}}
+	}
+	for _, iface := range c.Interfaces {
+		if iface.DNSServers == "" {
+			iface.DNSServers = c.DNSServers
+		}
+	}
+	if c.SMTP != nil {
+		if c.SMTP.TLS == "" {
+			c.SMTP.TLS = "starttls"
+		}
+		if c.SMTP.Port == 0 {
+			switch c.SMTP.TLS {
+			case "tls":
+				c.SMTP.Port = 465
+			case "none":
+				c.SMTP.Port = 25
+			default:
+				c.SMTP.Port = 587
+			}
+		}
+	}
+	return nil
+}
+
+// validate checks the config and the interfaces it describes, returning every problem joined into one error
+func (c *Config) validate() error {
+	var problems []error
+	problem := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Errorf(format, a...))
+	}
+
+	if c.MongoURI == "" {
+		problem("mongoURI is required, set it in the config file or %sMONGO_URI", configEnvironmentPrefix)
+	}
+	if info, err := os.Stat(c.Path); err != nil || !info.IsDir() {
+		problem("path %s is not a directory", c.Path)
+	} else if _, err := os.Stat(filepath.Join(c.Path, "scripts", "replace-string.sh")); err != nil {
+		problem("path %s does not contain scripts/replace-string.sh", c.Path)
+	}
+	for _, dns := range splitList(c.DNSServers) {
+		if _, err := netip.ParseAddr(dns); err != nil {
+			problem("dnsServers: invalid dns server %q", dns)
+		}
+	}
+
+	interfaceNames := map[string]bool{}
+	for _, iface := range c.Interfaces {
+		if iface.Name == "" {
+			problem("every interface needs a name")
+			continue
+		}
+		if interfaceNames[iface.Name] {
+			problem("interface %s is listed twice", iface.Name)
+			continue
+		}
+		interfaceNames[iface.Name] = true
+		if iface.DNSServers != c.DNSServers {
+			for _, dns := range splitList(iface.DNSServers) {
+				if _, err := netip.ParseAddr(dns); err != nil {
+					problem("interface %s: invalid dns server %q", iface.Name, dns)
+				}
+			}
+		}
+		if err := iface.Detect(); err != nil {
+			problems = append(problems, err)
+		}
+	}
+
+	problems = append(problems, c.HTTP.validate()...)
+	problems = append(problems, c.Log.validate()...)
+	problems = append(problems, c.Backup.validate()...)
+	if (c.AgentAddress == "") != (c.AgentToken == "") {
+		problem("agentAddress and agentToken must be set together")
+	}
+	if (c.AgentCertFile == "") != (c.AgentKeyFile == "") {
+		problem("agentCertFile and agentKeyFile must be set together")
+	} else if c.AgentCertFile != "" {
+		if _, err := tls.LoadX509KeyPair(c.AgentCertFile, c.AgentKeyFile); err != nil {
+			problem("agent: %s", err)
+		}
+	}
+	// the agent exports private keys, only this machine may reach it without TLS
+	if c.AgentAddress != "" && c.AgentCertFile == "" && !isLoopbackAddress(c.AgentAddress) {
+		problem("agentAddress %s is reachable from other machines, serve the agent over TLS with agentCertFile and agentKeyFile", c.AgentAddress)
+	}
+	nodeNames := map[string]bool{}
+	for _, n := range c.Nodes {
+		if n.Name == "" || n.Name == "local" || n.URL == "" || n.Token == "" {
+			problem("node %q needs a name other than local, a url and a token", n.Name)
+		} else if nodeNames[n.Name] {
+			problem("node %s is listed twice", n.Name)
+		}
+		nodeNames[n.Name] = true
+	}
+
+	if c.ClientConfigTemplate != "" {
+		if _, err := parseClientConfigTemplate(c.ClientConfigTemplate); err != nil {
+			problem("clientConfigTemplate: %s", err)
+		}
+	}
+	for group, settings := range c.GroupClientSettings {
+		if err := settings.validate(); err != nil {
+			problem("invalid client settings for group %s: %s", group, err)
+		}
+	}
+	var planNames []string
+	for _, plan := range c.Plans {
+		if plan.Name == "" {
+			problem("every plan needs a name")
+		} else if slices.Contains(planNames, plan.Name) {
+			problem("plan %s is listed twice", plan.Name)
+		}
+		planNames = append(planNames, plan.Name)
+		if plan.Days == 0 || plan.AllowedUsage == 0 {
+			problem("plan %s needs days and allowedUsage", plan.Name)
+		}
+		if plan.Interface != "" && !interfaceNames[plan.Interface] {
+			problem("plan %s uses unknown interface %s", plan.Name, plan.Interface)
+		}
+		if plan.ClientSettings != nil {
+			if err := plan.ClientSettings.validate(); err != nil {
+				problem("invalid client settings for plan %s: %s", plan.Name, err)
+			}
+		}
+	}
+
+	for i, w := range c.Webhooks {
+		if u, err := url.Parse(w.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problem("webhook %d: invalid url %q", i+1, w.URL)
+		}
+	}
+	if c.SMTP != nil {
+		if c.SMTP.Host == "" {
+			problem("smtp: host is required")
+		}
+		if _, err := mail.ParseAddress(c.SMTP.From); err != nil {
+			problem("smtp: invalid from address %q", c.SMTP.From)
+		}
+		if c.SMTP.TLS != "none" && c.SMTP.TLS != "starttls" && c.SMTP.TLS != "tls" {
+			problem("smtp: tls must be none, starttls or tls")
+		}
+		if c.SMTP.Port < 1 || c.SMTP.Port > 65535 {
+			problem("smtp: invalid port %d", c.SMTP.Port)
+		}
+	}
+	if c.MaxUpdateAge < 0 {
+		problem("maxUpdateAge can't be negative")
+	}
+	if c.MaxTelegramSubscribers < 0 {
+		problem("maxTelegramSubscribers can't be negative")
+	}
+	// chats can try the secret as often as they like
+	if c.TelegramOperatorSecret != "" && len(c.TelegramOperatorSecret) < 16 {
+		problem("telegramOperatorSecret must be at least 16 characters long")
+	}
+	if c.TrashDays < -1 {
+		problem("trashDays must be -1 or more")
+	}
+	return errors.Join(problems...)
+}
+
+// loadConfig reads and validates the config file at path and makes it the running config
+func loadConfig(path string) error {
+	c, err := readConfig(path)
+	if err != nil {
+		return err
+	}
+	if c.ClientConfigTemplate != "" {
+		if err = loadClientConfigTemplate(c.ClientConfigTemplate); err != nil {
+			return err
+		}
+	}
+	config = *c
+	config.Peers = make(map[string]*Peer)
+	config.Trash = make(map[string]*Peer)
+	setupLogging(config.Log)
+	return nil
+}
+
+// isLoopbackAddress reports whether a listen address only accepts connections from this machine
+func isLoopbackAddress(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip, err := netip.ParseAddr(host)
+	return err == nil && ip.IsLoopback()
+}
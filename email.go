@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type SMTPConfig struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	From     string `json:"from"`
+	// TLS is "none" for plain connections, "starttls" to upgrade after connecting or "tls" for implicit TLS, defaults to "starttls"
+	TLS string `json:"tls"`
+	// SendConfigOnCreate emails new peers that have an email address their config file and QR code
+	SendConfigOnCreate bool `json:"sendConfigOnCreate"`
+}
+
+type EmailAttachment struct {
+	Name        string
+	ContentType string
+	Data        []byte
+}
+
+// validateEmail returns the bare address part of email, an empty email is valid and removes the address
+func validateEmail(email string) (string, error) {
+	if email == "" {
+		return "", nil
+	}
+	address, err := mail.ParseAddress(email)
+	if err != nil {
+		return "", errors.New("invalid email")
+	}
+	return address.Address, nil
+}
+
+// sendEmail sends a message with the attachments through the configured SMTP server. It is called without holding
+// updateMutex, the server can take a while to answer.
+func sendEmail(to string, subject string, body string, attachments []EmailAttachment) error {
+	updateMutex.RLock()
+	smtpConfig := config.SMTP
+	updateMutex.RUnlock()
+	if smtpConfig == nil || smtpConfig.Host == "" {
+		return errors.New("smtp is not configured")
+	}
+
+	// build message
+	var message bytes.Buffer
+	writer := multipart.NewWriter(&message)
+	fmt.Fprintf(&message, "From: %s\r\n", smtpConfig.From)
+	fmt.Fprintf(&message, "To: %s\r\n", to)
+	fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&message, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&message, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", writer.Boundary())
+	part, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return err
+	}
+	part.Write([]byte(wrapBase64([]byte(body))))
+	for _, a := range attachments {
+		part, err := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {a.ContentType},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {fmt.Sprintf(`attachment; filename="%s"`, a.Name)},
+		})
+		if err != nil {
+			return err
+		}
+		part.Write([]byte(wrapBase64(a.Data)))
+	}
+	writer.Close()
+
+	// connect to server
+	address := net.JoinHostPort(smtpConfig.Host, strconv.Itoa(smtpConfig.Port))
+	var client *smtp.Client
+	if smtpConfig.TLS == "tls" {
+		conn, err := tls.Dial("tcp", address, &tls.Config{ServerName: smtpConfig.Host})
+		if err != nil {
+			return err
+		}
+		client, err = smtp.NewClient(conn, smtpConfig.Host)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+	} else {
+		client, err = smtp.Dial(address)
+		if err != nil {
+			return err
+		}
+		if smtpConfig.TLS != "none" {
+			if err = client.StartTLS(&tls.Config{ServerName: smtpConfig.Host}); err != nil {
+				client.Close()
+				return err
+			}
+		}
+	}
+	defer client.Close()
+
+	if smtpConfig.Username != "" {
+		if err = client.Auth(smtp.PlainAuth("", smtpConfig.Username, smtpConfig.Password, smtpConfig.Host)); err != nil {
+			return err
+		}
+	}
+	from, err := mail.ParseAddress(smtpConfig.From)
+	if err != nil {
+		return err
+	}
+	if err = client.Mail(from.Address); err != nil {
+		return err
+	}
+	if err = client.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(message.Bytes()); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// wrapBase64 encodes data as base64 split into 76 character lines as required for mime bodies
+func wrapBase64(data []byte) string {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	var lines []string
+	for len(encoded) > 76 {
+		lines = append(lines, encoded[:76])
+		encoded = encoded[76:]
+	}
+	lines = append(lines, encoded)
+	return strings.Join(lines, "\r\n")
+}
+
+// notifyEmail sends text to the peer's email address in the background
+func notifyEmail(peer *Peer, subject string, text string) {
+	if peer.Email == "" || config.SMTP == nil {
+		return
+	}
+	to, log := peer.Email, peerLog(peer)
+	go func() {
+		if err := sendEmail(to, subject, text, nil); err != nil {
+			slog.Warn("could not send email", log, "error", err)
+		}
+	}()
+}
+
+// sendPeerConfigEmail emails the peer its config file and the config's QR code. The message is built under the read
+// lock of updateMutex and sent after it is released, so the caller doesn't hold it.
+func sendPeerConfigEmail(peer *Peer) error {
+	updateMutex.RLock()
+	to, name := peer.Email, peer.Name
+	peerConfig := generateConfig(peer)
+	qr, err := peerQRCodePNG(peer, defaultQRCodeSize)
+	updateMutex.RUnlock()
+	if to == "" {
+		return errors.New("peer has no email")
+	}
+	if err != nil {
+		return err
+	}
+	return sendEmail(
+		to,
+		fmt.Sprintf(`اشتراک "%s"`, name),
+		fmt.Sprintf("فایل کانفیگ و کد QR اشتراک شما \"%s\" پیوست شده است.", name),
+		[]EmailAttachment{
+			{Name: name + ".conf", ContentType: "text/plain; charset=utf-8", Data: []byte(peerConfig)},
+			{Name: name + ".png", ContentType: "image/png", Data: qr},
+		},
+	)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// fakeSMTP is an SMTP server on localhost that accepts one message, its envelope is set once the data is sent on data
+type fakeSMTP struct {
+	listener net.Listener
+	from     string
+	to       []string
+	data     chan string
+}
+
+func startFakeSMTP(t *testing.T) *fakeSMTP {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTP{listener: l, data: make(chan string, 1)}
+	t.Cleanup(func() { l.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *fakeSMTP) serve() {
+	conn, err := s.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 localhost ESMTP")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch command {
+		case "EHLO", "HELO":
+			text.PrintfLine("250 localhost")
+		case "MAIL":
+			s.from = strings.TrimPrefix(line, "MAIL FROM:")
+			text.PrintfLine("250 OK")
+		case "RCPT":
+			s.to = append(s.to, strings.TrimPrefix(line, "RCPT TO:"))
+			text.PrintfLine("250 OK")
+		case "DATA":
+			text.PrintfLine("354 end data with <CR><LF>.<CR><LF>")
+			data, err := io.ReadAll(text.DotReader())
+			if err != nil {
+				return
+			}
+			s.data <- string(data)
+			text.PrintfLine("250 OK")
+		case "QUIT":
+			text.PrintfLine("221 bye")
+			return
+		default:
+			text.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+func TestSendEmail(t *testing.T) {
+	s := startFakeSMTP(t)
+	previous := config.SMTP
+	t.Cleanup(func() { config.SMTP = previous })
+	port := s.listener.Addr().(*net.TCPAddr).Port
+	config.SMTP = &SMTPConfig{Host: "127.0.0.1", Port: port, From: "Wireguard UI <ui@example.com>", TLS: "none"}
+
+	attachment := []byte("[Interface]\nPrivateKey = test\n")
+	err := sendEmail("peer@example.com", "اشتراک test-1", "config attached", []EmailAttachment{
+		{Name: "test-1.conf", ContentType: "text/plain; charset=utf-8", Data: attachment},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := <-s.data
+
+	if s.from != "<ui@example.com>" {
+		t.Errorf("MAIL FROM is %q, want <ui@example.com>", s.from)
+	}
+	if len(s.to) != 1 || s.to[0] != "<peer@example.com>" {
+		t.Errorf("RCPT TO is %q, want <peer@example.com>", s.to)
+	}
+
+	message, err := mail.ReadMessage(bufio.NewReader(strings.NewReader(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if to := message.Header.Get("To"); to != "peer@example.com" {
+		t.Errorf("To is %q", to)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(message.Header.Get("Subject"))
+	if err != nil || subject != "اشتراک test-1" {
+		t.Errorf("Subject is %q (%v)", subject, err)
+	}
+	mediaType, params, err := mime.ParseMediaType(message.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("Content-Type is %q (%v)", message.Header.Get("Content-Type"), err)
+	}
+
+	var parts []string
+	var names []string
+	reader := multipart.NewReader(message.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(string(encoded), "\r\n", ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, string(decoded))
+		names = append(names, part.FileName())
+	}
+	if len(parts) != 2 {
+		t.Fatalf("message has %d parts, want the body and one attachment", len(parts))
+	}
+	if parts[0] != "config attached" {
+		t.Errorf("body is %q", parts[0])
+	}
+	if names[1] != "test-1.conf" || parts[1] != string(attachment) {
+		t.Errorf("attachment is %q with %q", names[1], parts[1])
+	}
+}
+
+func TestSendEmailWithoutSMTP(t *testing.T) {
+	previous := config.SMTP
+	t.Cleanup(func() { config.SMTP = previous })
+	config.SMTP = nil
+	if err := sendEmail("peer@example.com", "subject", "body", nil); err == nil {
+		t.Error("sendEmail without smtp settings succeeded")
+	}
+}
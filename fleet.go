@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Node is a remote server running its own wireguard-ui with the node agent enabled
+type Node struct {
+	Name  string `json:"name"`
+	URL   string `json:"url"`
+	Token string `json:"token"`
+
+	mutex    sync.RWMutex
+	online   bool
+	lastSeen int64
+	lastErr  string
+	peers    []AgentPeer
+}
+
+type NodeStatus struct {
+	Name         string `json:"name"`
+	URL          string `json:"url"`
+	Online       bool   `json:"online"`
+	LastSeen     int64  `json:"lastSeen"`
+	Error        string `json:"error,omitempty"`
+	Peers        int    `json:"peers"`
+	TotalUsage   uint64 `json:"totalUsage"`
+	CurrentRx    uint64 `json:"currentRx"`
+	CurrentTx    uint64 `json:"currentTx"`
+	AllowedUsage uint64 `json:"allowedUsage"`
+}
+
+// FleetPeerUsage is a peer's usage summed over every node it exists on
+type FleetPeerUsage struct {
+	Name         string   `json:"name"`
+	TotalUsage   uint64   `json:"totalUsage"`
+	AllowedUsage uint64   `json:"allowedUsage"`
+	CurrentRx    uint64   `json:"currentRx"`
+	CurrentTx    uint64   `json:"currentTx"`
+	Nodes        []string `json:"nodes"`
+}
+
+var errNodeNotFound = errors.New("node not found")
+
+func findNode(name string) *Node {
+	for _, n := range config.Nodes {
+		if n.Name == name {
+			return n
+		}
+	}
+	return nil
+}
+
+// request calls the node agent and decodes the json response into out if it isn't nil. Names in path are escaped by the caller.
+func (n *Node) request(method string, path string, body interface{}, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, strings.TrimRight(n.URL, "/")+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+n.Token)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := (&http.Client{Timeout: 30 * time.Second}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		e := map[string]interface{}{}
+		json.NewDecoder(res.Body).Decode(&e)
+		if msg, ok := e["error"].(string); ok {
+			return fmt.Errorf("%s: %s", n.Name, msg)
+		}
+		return fmt.Errorf("%s: %s", n.Name, res.Status)
+	}
+	if out != nil {
+		return json.NewDecoder(res.Body).Decode(out)
+	}
+	return nil
+}
+
+// watch keeps the node's peers up to date from the agent's stats stream, reconnecting when it drops
+func (n *Node) watch() {
+	for {
+		err := n.stream()
+		n.mutex.Lock()
+		n.online = false
+		if err != nil {
+			n.lastErr = err.Error()
+		}
+		n.mutex.Unlock()
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func (n *Node) stream() error {
+	req, err := http.NewRequest("GET", strings.TrimRight(n.URL, "/")+"/agent/stats", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+n.Token)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("stats stream returned %s", res.Status)
+	}
+
+	scanner := bufio.NewScanner(res.Body)
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		var peers []AgentPeer
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data:")), &peers); err != nil {
+			return err
+		}
+		n.mutex.Lock()
+		n.online = true
+		n.lastSeen = time.Now().Unix()
+		n.lastErr = ""
+		n.peers = peers
+		n.mutex.Unlock()
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return errors.New("stats stream closed")
+}
+
+func (n *Node) Peers() []AgentPeer {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	return n.peers
+}
+
+func (n *Node) Status() NodeStatus {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	status := NodeStatus{
+		Name:     n.Name,
+		URL:      n.URL,
+		Online:   n.online,
+		LastSeen: n.lastSeen,
+		Error:    n.lastErr,
+		Peers:    len(n.peers),
+	}
+	for _, p := range n.peers {
+		status.TotalUsage += p.TotalUsage
+		status.AllowedUsage += p.AllowedUsage
+		status.CurrentRx += p.CurrentRx
+		status.CurrentTx += p.CurrentTx
+	}
+	return status
+}
+
+// fleetUsage sums the usage of peers with the same name over this server and all nodes
+func fleetUsage() []FleetPeerUsage {
+	usage := map[string]*FleetPeerUsage{}
+	add := func(node string, p AgentPeer) {
+		u := usage[p.Name]
+		if u == nil {
+			u = &FleetPeerUsage{Name: p.Name}
+			usage[p.Name] = u
+		}
+		u.TotalUsage += p.TotalUsage
+		u.AllowedUsage += p.AllowedUsage
+		u.CurrentRx += p.CurrentRx
+		u.CurrentTx += p.CurrentTx
+		u.Nodes = append(u.Nodes, node)
+	}
+	for _, p := range agentPeers() {
+		add("local", p)
+	}
+	for _, n := range config.Nodes {
+		for _, p := range n.Peers() {
+			add(n.Name, p)
+		}
+	}
+	result := []FleetPeerUsage{}
+	for _, u := range usage {
+		result = append(result, *u)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// movePeer copies a peer with its keys, limits and usage from one node to another and deletes it from the source.
+// The name "local" refers to this server.
+func movePeer(name string, from string, to string, interfaceName string) (*AgentPeer, error) {
+	if from == to {
+		return nil, errors.New("source and destination are the same")
+	}
+
+	// export from source
+	var exported AgentPeer
+	if from == "local" {
+		updateMutex.RLock()
+		p := findPeerByName(name)
+		if p != nil {
+			exported = toAgentPeer(p, true)
+		}
+		updateMutex.RUnlock()
+		if p == nil {
+			return nil, errors.New("peer not found")
+		}
+	} else {
+		n := findNode(from)
+		if n == nil {
+			return nil, errNodeNotFound
+		}
+		if err := n.request("GET", "/agent/peers/"+url.PathEscape(name)+"/export", nil, &exported); err != nil {
+			return nil, err
+		}
+	}
+	exported.Interface = interfaceName
+
+	// import into destination
+	var imported AgentPeer
+	if to == "local" {
+		updateMutex.Lock()
+		p, err := importPeer(exported)
+		if err == nil {
+			imported = toAgentPeer(p, false)
+		}
+		updateMutex.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		n := findNode(to)
+		if n == nil {
+			return nil, errNodeNotFound
+		}
+		if err := n.request("POST", "/agent/import", exported, &imported); err != nil {
+			return nil, err
+		}
+	}
+
+	// remove from source
+	var err error
+	// the peer lives on at the destination with the same keys, so it isn't kept in the source's trash
+	if from == "local" {
+		updateMutex.Lock()
+		err = deletePeer(name, "move", true)
+		updateMutex.Unlock()
+	} else {
+		err = findNode(from).request("DELETE", "/agent/peers/"+url.PathEscape(name)+"?purge=true", nil, nil)
+	}
+	if err != nil {
+		return &imported, fmt.Errorf("peer was copied to %s but not removed from %s: %s", to, from, err)
+	}
+	return &imported, nil
+}
+
+// registerFleetRoutes adds the admin endpoints for managing peers on remote nodes
+func registerFleetRoutes(r *gin.Engine) {
+	// the fleet endpoints wait for remote nodes, so they don't hold updateMutex while they run
+	admin := func(c *gin.Context) {
+		if _, role := requestClient(c); role != "admin" {
+			c.AbortWithStatus(403)
+			return
+		}
+		c.Next()
+	}
+	node := func(c *gin.Context) *Node {
+		n := findNode(c.Param("node"))
+		if n == nil {
+			c.AbortWithStatus(404)
+		}
+		return n
+	}
+
+	r.GET("/api/nodes", admin, func(c *gin.Context) {
+		statuses := []NodeStatus{}
+		for _, n := range config.Nodes {
+			statuses = append(statuses, n.Status())
+		}
+		c.JSON(200, statuses)
+	})
+	r.GET("/api/fleet/usage", admin, readPeers, func(c *gin.Context) {
+		c.JSON(200, fleetUsage())
+	})
+	r.GET("/api/nodes/:node/peers", admin, func(c *gin.Context) {
+		if n := node(c); n != nil {
+			c.JSON(200, n.Peers())
+		}
+	})
+	r.POST("/api/nodes/:node/peers/:name", admin, func(c *gin.Context) {
+		n := node(c)
+		if n == nil {
+			return
+		}
+		req := AgentCreatePeerRequest{}
+		if err := c.BindJSON(&req); err != nil {
+			return
+		}
+		var created AgentPeer
+		if err := n.request("POST", "/agent/peers/"+url.PathEscape(c.Param("name")), req, &created); err != nil {
+			c.Error(err)
+			c.JSON(400, map[string]interface{}{"error": err.Error()})
+			return
+		}
+		c.JSON(201, created)
+	})
+	r.DELETE("/api/nodes/:node/peers/:name", admin, func(c *gin.Context) {
+		n := node(c)
+		if n == nil {
+			return
+		}
+		if err := n.request("DELETE", "/agent/peers/"+url.PathEscape(c.Param("name")), nil, nil); err != nil {
+			c.Error(err)
+			c.JSON(400, map[string]interface{}{"error": err.Error()})
+			return
+		}
+		c.AbortWithStatus(200)
+	})
+	r.POST("/api/nodes/:node/peers/:name/:action", admin, func(c *gin.Context) {
+		n := node(c)
+		if n == nil {
+			return
+		}
+		action := c.Param("action")
+		if action != "suspend" && action != "resume" {
+			c.AbortWithStatus(404)
+			return
+		}
+		req := AgentPeerStateRequest{}
+		if c.Request.ContentLength != 0 {
+			if err := c.BindJSON(&req); err != nil {
+				return
+			}
+		}
+		req.Actor, _ = requestClient(c)
+		var updated AgentPeer
+		if err := n.request("POST", "/agent/peers/"+url.PathEscape(c.Param("name"))+"/"+action, req, &updated); err != nil {
+			c.Error(err)
+			c.JSON(400, map[string]interface{}{"error": err.Error()})
+			return
+		}
+		c.JSON(200, updated)
+	})
+	r.POST("/api/move-peer/:name", admin, func(c *gin.Context) {
+		req := struct {
+			From      string `json:"from"`
+			To        string `json:"to"`
+			Interface string `json:"interface"`
+		}{}
+		if err := c.BindJSON(&req); err != nil {
+			return
+		}
+		moved, err := movePeer(c.Param("name"), req.From, req.To, req.Interface)
+		if err != nil {
+			c.Error(err)
+			c.JSON(400, map[string]interface{}{"error": err.Error()})
+			return
+		}
+		c.JSON(200, moved)
+	})
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// useTestConfig restores the running config when the test ends
+func useTestConfig(t *testing.T) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.Peers = map[string]*Peer{}
+	config.Trash = map[string]*Peer{}
+	config.Nodes = nil
+}
+
+// fakeAgent is a node agent on localhost that serves a fixed list of peers and records the requests it gets
+type fakeAgent struct {
+	server *httptest.Server
+	token  string
+	peers  []AgentPeer
+
+	mutex    sync.Mutex
+	requests []string
+	bodies   map[string]string
+}
+
+func startFakeAgent(t *testing.T, token string, peers ...AgentPeer) *fakeAgent {
+	t.Helper()
+	a := &fakeAgent{token: token, peers: peers, bodies: map[string]string{}}
+	a.server = httptest.NewServer(http.HandlerFunc(a.handle))
+	t.Cleanup(a.server.Close)
+	return a
+}
+
+func (a *fakeAgent) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer "+a.token {
+		w.WriteHeader(401)
+		return
+	}
+	// the unescaped path is recorded, so a name that wasn't escaped shows up cut at the ? or /
+	request := r.Method + " " + r.URL.Path
+	if r.URL.RawQuery != "" {
+		request += "?" + r.URL.RawQuery
+	}
+	var body json.RawMessage
+	json.NewDecoder(r.Body).Decode(&body)
+	a.mutex.Lock()
+	a.requests = append(a.requests, request)
+	a.bodies[request] = string(body)
+	a.mutex.Unlock()
+
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/agent/stats":
+		data, _ := json.Marshal(a.peers)
+		w.Write([]byte("event:stats\ndata:" + string(data) + "\n\n"))
+	case r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/export"):
+		name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/agent/peers/"), "/export")
+		for _, p := range a.peers {
+			if p.Name == name {
+				p.PrivateKey, p.PresharedKey = "private-"+name, "preshared-"+name
+				json.NewEncoder(w).Encode(p)
+				return
+			}
+		}
+		w.WriteHeader(404)
+	case r.Method == "POST" && r.URL.Path == "/agent/import":
+		w.WriteHeader(201)
+		w.Write(body)
+	default:
+		w.Write([]byte("{}"))
+	}
+}
+
+func (a *fakeAgent) received() []string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return slices.Clone(a.requests)
+}
+
+func (a *fakeAgent) body(request string) string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.bodies[request]
+}
+
+func TestAgentRouter(t *testing.T) {
+	useTestConfig(t)
+	config.AgentToken = "agent-token"
+	config.Peers["pk-2"] = &Peer{Name: "shop-2", PublicKey: "pk-2", PrivateKey: "private-2", PresharedKey: "preshared-2", TotalUsage: 2}
+	config.Peers["pk-1"] = &Peer{Name: "shop-1", PublicKey: "pk-1", PrivateKey: "private-1", PresharedKey: "preshared-1", TotalUsage: 1}
+	server := httptest.NewServer(agentRouter())
+	defer server.Close()
+	n := &Node{Name: "agent", URL: server.URL, Token: "agent-token"}
+
+	var peers []AgentPeer
+	if err := n.request("GET", "/agent/peers", nil, &peers); err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 2 || peers[0].Name != "shop-1" || peers[1].Name != "shop-2" {
+		t.Fatalf("peers are %+v, want shop-1 and shop-2", peers)
+	}
+	if peers[0].PrivateKey != "" || peers[0].PresharedKey != "" {
+		t.Error("the peer list carries keys")
+	}
+
+	var exported AgentPeer
+	if err := n.request("GET", "/agent/peers/"+url.PathEscape("shop-1")+"/export", nil, &exported); err != nil {
+		t.Fatal(err)
+	}
+	if exported.PrivateKey != "private-1" || exported.PresharedKey != "preshared-1" {
+		t.Errorf("export has keys %q and %q", exported.PrivateKey, exported.PresharedKey)
+	}
+	if err := n.request("GET", "/agent/peers/missing/export", nil, nil); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("export of a missing peer returned %v, want 404", err)
+	}
+
+	wrongToken := &Node{Name: "agent", URL: server.URL, Token: "wrong"}
+	if err := wrongToken.request("GET", "/agent/peers", nil, nil); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("request with a wrong token returned %v, want 401", err)
+	}
+}
+
+func TestFleetWithSeveralAgents(t *testing.T) {
+	useTestConfig(t)
+	config.Peers["pk-admin"] = &Peer{Name: "Admin-0", PublicKey: "pk-admin", Role: "admin", Address: "127.0.0.1"}
+	config.Peers["pk-1"] = &Peer{Name: "shop-1", PublicKey: "pk-1", TotalUsage: 1}
+	de := startFakeAgent(t, "de-token", AgentPeer{Name: "shop-1", TotalUsage: 2}, AgentPeer{Name: "shop-2", TotalUsage: 3})
+	nl := startFakeAgent(t, "nl-token", AgentPeer{Name: "shop-1", TotalUsage: 4})
+	config.Nodes = []*Node{
+		{Name: "de-1", URL: de.server.URL, Token: "de-token"},
+		{Name: "nl-1", URL: nl.server.URL + "/", Token: "nl-token"},
+	}
+
+	// each stats stream sends one event and ends
+	for _, n := range config.Nodes {
+		if err := n.stream(); err == nil || err.Error() != "stats stream closed" {
+			t.Fatalf("stream of %s ended with %v", n.Name, err)
+		}
+	}
+	if status := config.Nodes[0].Status(); !status.Online || status.Peers != 2 || status.TotalUsage != 5 {
+		t.Errorf("status of de-1 is %+v", status)
+	}
+
+	usage := map[string]FleetPeerUsage{}
+	for _, u := range fleetUsage() {
+		usage[u.Name] = u
+	}
+	if u := usage["shop-1"]; u.TotalUsage != 7 || !slices.Equal(u.Nodes, []string{"local", "de-1", "nl-1"}) {
+		t.Errorf("fleet usage of shop-1 is %+v", u)
+	}
+	if u := usage["shop-2"]; u.TotalUsage != 3 || !slices.Equal(u.Nodes, []string{"de-1"}) {
+		t.Errorf("fleet usage of shop-2 is %+v", u)
+	}
+
+	moved, err := movePeer("shop-2", "de-1", "nl-1", "wg1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved.Name != "shop-2" || moved.Interface != "wg1" || moved.PrivateKey != "private-shop-2" {
+		t.Errorf("moved peer is %+v", moved)
+	}
+	if got, want := de.received(), []string{"GET /agent/stats", "GET /agent/peers/shop-2/export", "DELETE /agent/peers/shop-2?purge=true"}; !slices.Equal(got, want) {
+		t.Errorf("de-1 got %q, want %q", got, want)
+	}
+	if got, want := nl.received(), []string{"GET /agent/stats", "POST /agent/import"}; !slices.Equal(got, want) {
+		t.Errorf("nl-1 got %q, want %q", got, want)
+	}
+
+	// names are escaped on their way to the agent
+	r := gin.New()
+	registerFleetRoutes(r)
+	server := httptest.NewServer(r)
+	defer server.Close()
+	res, err := http.Post(server.URL+"/api/nodes/de-1/peers/"+url.PathEscape("a?b c")+"/suspend", "application/json", strings.NewReader(`{"reason":"test"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("suspend through the fleet api returned %s", res.Status)
+	}
+	received := de.received()
+	if last := received[len(received)-1]; last != "POST /agent/peers/a?b c/suspend" {
+		t.Errorf("de-1 got %q, want the escaped name", last)
+	}
+	state := AgentPeerStateRequest{}
+	json.Unmarshal([]byte(de.body("POST /agent/peers/a?b c/suspend")), &state)
+	if state.Reason != "test" || state.Actor != "Admin-0" {
+		t.Errorf("suspend was sent with %+v", state)
+	}
+}
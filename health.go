@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// lastUpdateAt is the unix time the peer update loop last finished a run
+var lastUpdateAt atomic.Int64
+
+type HealthCheck struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type Readiness struct {
+	Ready  bool                   `json:"ready"`
+	Checks map[string]HealthCheck `json:"checks"`
+}
+
+// readiness checks the store, the wireguard interfaces, the peer update loop and the telegram bot
+func readiness() Readiness {
+	r := Readiness{Ready: true, Checks: map[string]HealthCheck{}}
+	check := func(name string, ok bool, detail string) {
+		r.Checks[name] = HealthCheck{OK: ok, Detail: detail}
+		r.Ready = r.Ready && ok
+	}
+
+	status := storeStatus()
+	if status.Connected {
+		check("store", true, fmt.Sprintf("%d pending writes", status.PendingWrites))
+	} else {
+		check("store", false, status.LastError)
+	}
+
+	for _, iface := range config.Interfaces {
+		if _, err := net.InterfaceByName(iface.Name); err != nil {
+			check("interface "+iface.Name, false, err.Error())
+		} else {
+			check("interface "+iface.Name, true, "")
+		}
+	}
+
+	updateMutex.RLock()
+	maxAge := int64(config.MaxUpdateAge)
+	botToken, bot := config.TelegramBotToken, config.TelegramBot
+	updateMutex.RUnlock()
+	age := time.Now().Unix() - lastUpdateAt.Load()
+	if lastUpdateAt.Load() == 0 {
+		check("updates", false, "peers haven't been updated yet")
+	} else {
+		check("updates", age <= maxAge, fmt.Sprintf("last run %d seconds ago", age))
+	}
+
+	if botToken != "" {
+		if bot == nil {
+			check("telegram", false, "bot isn't connected")
+		} else {
+			check("telegram", true, "@"+bot.Self.UserName)
+		}
+	}
+	return r
+}
+
+// registerHealthRoutes adds the unauthenticated liveness and readiness endpoints for load balancers and monitoring
+func registerHealthRoutes(r *gin.Engine) {
+	r.GET("/healthz", func(c *gin.Context) {
+		c.JSON(200, map[string]interface{}{"status": "ok"})
+	})
+	r.GET("/readyz", func(c *gin.Context) {
+		result := readiness()
+		if !result.Ready {
+			c.JSON(503, result)
+			return
+		}
+		c.JSON(200, result)
+	})
+}
+
+// sdNotify sends a state to systemd when running as a Type=notify service, it does nothing otherwise
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		slog.Warn("could not notify systemd", "state", state, "error", err)
+		return
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte(state)); err != nil {
+		slog.Warn("could not notify systemd", "state", state, "error", err)
+	}
+}
+
+// runWatchdog pings the systemd watchdog at half its interval while the peer update loop is running,
+// so systemd restarts the service if the loop hangs
+func runWatchdog() {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	interval := time.Duration(usec) * time.Microsecond / 2
+	for range time.NewTicker(interval).C {
+		updateMutex.RLock()
+		maxAge := int64(config.MaxUpdateAge)
+		updateMutex.RUnlock()
+		if time.Now().Unix()-lastUpdateAt.Load() <= maxAge {
+			sdNotify("WATCHDOG=1")
+		}
+	}
+}
@@ -0,0 +1,662 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// import sources, stored in the importedFrom field of imported peers
+const (
+	importFromInterface = "interface"
+	importFromWgEasy    = "wg-easy"
+	importFromConf      = "conf"
+	importFromCSV       = "csv"
+)
+
+type ImportOptions struct {
+	// Interface is the interface peers without one are imported into, empty selects the first
+	Interface string
+	// Plan, Days and AllowedUsage set the expiry and limit of peers the source has none for,
+	// Days and AllowedUsage win over the plan, without either the defaults of new peers apply
+	Plan         *Plan
+	Days         uint64
+	AllowedUsage uint64
+	Role         string
+	// Prefix starts the placeholder names of peers the source has no name for, defaults to "imported"
+	Prefix string
+	// DryRun checks every peer and reports what would happen without changing anything
+	DryRun bool
+}
+
+type ImportResult struct {
+	Name      string `json:"name"`
+	PublicKey string `json:"publicKey"`
+	Interface string `json:"interface"`
+	Address   string `json:"address"`
+	// Status is imported, ok for peers a dry run would import, skipped for peers that are already managed, or failed
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+	// NewPresharedKey is set when the source had no preshared key and one was generated, the client needs a new config
+	NewPresharedKey bool `json:"newPresharedKey,omitempty"`
+}
+
+// unmanagedPeers returns the peers in the interface's config file or on the running device that aren't managed yet
+func unmanagedPeers(iface *Interface) ([]*Peer, error) {
+	configBytes, err := os.ReadFile(iface.ConfigPath())
+	if err != nil {
+		return nil, err
+	}
+	var peers []*Peer
+	seen := map[string]bool{}
+	for _, section := range parseWireguardConfig(string(configBytes)) {
+		publicKey := section.Values["PublicKey"]
+		if section.Name != "Peer" || publicKey == "" || config.Peers[publicKey] != nil || config.Trash[publicKey] != nil || retiredKeyOwner(publicKey) != nil || seen[publicKey] {
+			continue
+		}
+		seen[publicKey] = true
+		peers = append(peers, &Peer{PublicKey: publicKey, Interface: iface.Name})
+	}
+	// peers added with `wg set` and never saved are only on the device
+	lines, err := iface.Dump()
+	if err != nil {
+		slog.Warn("could not read interface, only its config file is imported", "interface", iface.Name, "error", err)
+	}
+	for _, line := range lines {
+		publicKey := strings.Split(line, "\t")[0]
+		if config.Peers[publicKey] != nil || config.Trash[publicKey] != nil || retiredKeyOwner(publicKey) != nil || seen[publicKey] {
+			continue
+		}
+		seen[publicKey] = true
+		peers = append(peers, &Peer{PublicKey: publicKey, Interface: iface.Name})
+	}
+	return peers, nil
+}
+
+// parseWgEasy reads the wg0.json file of wg-easy
+func parseWgEasy(data []byte) ([]*Peer, error) {
+	var file struct {
+		Clients map[string]struct {
+			Name         string `json:"name"`
+			Address      string `json:"address"`
+			PrivateKey   string `json:"privateKey"`
+			PublicKey    string `json:"publicKey"`
+			PreSharedKey string `json:"preSharedKey"`
+			Enabled      *bool  `json:"enabled"`
+			ExpiredAt    string `json:"expiredAt"`
+		} `json:"clients"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("not a wg-easy file: %s", err)
+	}
+	if file.Clients == nil {
+		return nil, errors.New("not a wg-easy file: clients are missing")
+	}
+	var peers []*Peer
+	for _, c := range file.Clients {
+		p := &Peer{
+			Name:         strings.TrimSpace(c.Name),
+			Address:      c.Address,
+			PrivateKey:   c.PrivateKey,
+			PublicKey:    c.PublicKey,
+			PresharedKey: c.PreSharedKey,
+			Disabled:     c.Enabled != nil && !*c.Enabled,
+		}
+		if c.ExpiredAt != "" {
+			expiresAt, err := time.Parse(time.RFC3339, c.ExpiredAt)
+			if err != nil {
+				return nil, fmt.Errorf("client %s: invalid expiredAt %q", c.Name, c.ExpiredAt)
+			}
+			p.ExpiresAt = uint64(expiresAt.Unix())
+		}
+		peers = append(peers, p)
+	}
+	// clients are keyed by id, sort them so imports are repeatable
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Name < peers[j].Name })
+	return peers, nil
+}
+
+// parseClientConfig reads a client config file, the peer is named after the file
+func parseClientConfig(fileName string, data []byte) (*Peer, error) {
+	p := &Peer{Name: strings.TrimSuffix(filepath.Base(fileName), ".conf")}
+	for _, section := range parseWireguardConfig(string(data)) {
+		switch section.Name {
+		case "Interface":
+			p.PrivateKey = section.Values["PrivateKey"]
+			for _, address := range splitList(section.Values["Address"]) {
+				if prefix, err := netip.ParsePrefix(address); err == nil && prefix.Addr().Is4() {
+					p.Address = prefix.Addr().String()
+					break
+				}
+				if addr, err := netip.ParseAddr(address); err == nil && addr.Is4() {
+					p.Address = addr.String()
+					break
+				}
+			}
+		case "Peer":
+			p.PresharedKey = section.Values["PresharedKey"]
+		}
+	}
+	if p.PrivateKey == "" {
+		return nil, fmt.Errorf("%s: no private key in the [Interface] section", fileName)
+	}
+	return p, nil
+}
+
+// importCandidates reads the peers of a source from its files, keyed by file name. Peers on the interfaces need no files,
+// interfaceName limits them to one interface.
+func importCandidates(from string, files map[string][]byte, interfaceName string) ([]*Peer, error) {
+	if from == importFromInterface {
+		var candidates []*Peer
+		for _, iface := range config.Interfaces {
+			if interfaceName != "" && iface.Name != interfaceName {
+				continue
+			}
+			peers, err := unmanagedPeers(iface)
+			if err != nil {
+				return nil, err
+			}
+			candidates = append(candidates, peers...)
+		}
+		return candidates, nil
+	}
+	if len(files) == 0 {
+		return nil, errors.New("no files to import")
+	}
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	switch from {
+	case importFromConf:
+		var candidates []*Peer
+		for _, name := range names {
+			p, err := parseClientConfig(name, files[name])
+			if err != nil {
+				return nil, err
+			}
+			candidates = append(candidates, p)
+		}
+		return candidates, nil
+	case importFromWgEasy, importFromCSV:
+		if len(files) != 1 {
+			return nil, fmt.Errorf("%s imports read a single file", from)
+		}
+		if from == importFromWgEasy {
+			return parseWgEasy(files[names[0]])
+		}
+		return parseImportCSV(files[names[0]])
+	}
+	return nil, fmt.Errorf("unknown import source %q, use interface, wg-easy, conf or csv", from)
+}
+
+// importCSVColumns are the columns a csv file may have, matched case-insensitively. Every peer needs a public or private key.
+var importCSVColumns = []string{"name", "interface", "address", "publickey", "privatekey", "presharedkey", "expiresat", "allowedusagegb", "totalusagegb", "email", "role", "disabled"}
+
+// parseImportCSV reads peers from a csv file with a header row
+func parseImportCSV(data []byte) ([]*Peer, error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.TrimLeadingSpace = true
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("csv: %s", err)
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !slices.Contains(importCSVColumns, name) {
+			return nil, fmt.Errorf("csv: unknown column %q, columns are %s", header[i], strings.Join(importCSVColumns, ", "))
+		}
+		columns[name] = i
+	}
+	if _, ok := columns["publickey"]; !ok {
+		if _, ok := columns["privatekey"]; !ok {
+			return nil, errors.New("csv: a publicKey or privateKey column is required")
+		}
+	}
+
+	var peers []*Peer
+	for line := 2; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			return peers, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("csv: %s", err)
+		}
+		value := func(column string) string {
+			if i, ok := columns[column]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		p := &Peer{
+			Name:         value("name"),
+			Interface:    value("interface"),
+			Address:      value("address"),
+			PublicKey:    value("publickey"),
+			PrivateKey:   value("privatekey"),
+			PresharedKey: value("presharedkey"),
+			Role:         value("role"),
+		}
+		if p.Role != "" && p.Role != "user" && p.Role != "distributor" && p.Role != "admin" {
+			return nil, fmt.Errorf("csv line %d: unknown role %q", line, p.Role)
+		}
+		if p.Email, err = validateEmail(value("email")); err != nil {
+			return nil, fmt.Errorf("csv line %d: %s", line, err)
+		}
+		if v := value("expiresat"); v != "" {
+			if p.ExpiresAt, err = parseImportTime(v); err != nil {
+				return nil, fmt.Errorf("csv line %d: %s", line, err)
+			}
+		}
+		if v := value("allowedusagegb"); v != "" {
+			gb, err := strconv.ParseFloat(v, 64)
+			if err != nil || gb < 0 {
+				return nil, fmt.Errorf("csv line %d: invalid allowedUsageGB %q", line, v)
+			}
+			p.AllowedUsage = uint64(gb * gigabyte)
+		}
+		if v := value("totalusagegb"); v != "" {
+			gb, err := strconv.ParseFloat(v, 64)
+			if err != nil || gb < 0 {
+				return nil, fmt.Errorf("csv line %d: invalid totalUsageGB %q", line, v)
+			}
+			p.TotalUsage = uint64(gb * gigabyte)
+		}
+		if v := value("disabled"); v != "" {
+			if p.Disabled, err = strconv.ParseBool(v); err != nil {
+				return nil, fmt.Errorf("csv line %d: invalid disabled %q", line, v)
+			}
+		}
+		peers = append(peers, p)
+	}
+}
+
+// parseImportTime reads a unix time, a date or an RFC 3339 time
+func parseImportTime(v string) (uint64, error) {
+	if unix, err := strconv.ParseUint(v, 10, 64); err == nil {
+		return unix, nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err := time.Parse(layout, v); err == nil {
+			return uint64(t.Unix()), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid time %q, use a unix time, 2006-01-02 or RFC 3339", v)
+}
+
+// livePeer is a peer's entry in an interface's config file or on its device
+type livePeer struct {
+	presharedKey string
+	allowedIPs   string
+}
+
+// livePeers returns the peers in the interface's config file and on its device by public key, the config file wins
+func livePeers(iface *Interface, configText string) map[string]livePeer {
+	peers := map[string]livePeer{}
+	lines, _ := iface.Dump()
+	for _, line := range lines {
+		info := strings.Split(line, "\t")
+		if len(info) < 4 {
+			continue
+		}
+		psk := info[1]
+		if psk == "(none)" {
+			psk = ""
+		}
+		peers[info[0]] = livePeer{presharedKey: psk, allowedIPs: info[3]}
+	}
+	for _, section := range parseWireguardConfig(configText) {
+		if section.Name == "Peer" && section.Values["PublicKey"] != "" {
+			peers[section.Values["PublicKey"]] = livePeer{presharedKey: section.Values["PresharedKey"], allowedIPs: section.Values["AllowedIPs"]}
+		}
+	}
+	return peers
+}
+
+// singleAddress returns the address of an allowed ips list that is exactly one ipv4 host
+func singleAddress(allowedIPs string) (netip.Addr, bool) {
+	prefixes, err := parsePrefixes(allowedIPs)
+	if err != nil || len(prefixes) != 1 || !prefixes[0].Addr().Is4() || prefixes[0].Bits() != 32 {
+		return netip.Addr{}, false
+	}
+	return prefixes[0].Addr(), true
+}
+
+// nextFreeAddress returns the first host address of the network after the server's that isn't used
+func nextFreeAddress(network netip.Prefix, used map[netip.Addr]bool) (netip.Addr, error) {
+	masked := network.Masked()
+	for a := network.Addr().Next(); masked.Contains(a); a = a.Next() {
+		// skip the broadcast address
+		if !masked.Contains(a.Next()) {
+			break
+		}
+		if !used[a] {
+			return a, nil
+		}
+	}
+	return netip.Addr{}, errors.New("no free address left in " + masked.String())
+}
+
+// removePeerSections drops the [Peer] sections with the given public keys from a wireguard config.
+// Comments and blank lines at the end of a dropped section are kept, they usually describe the next peer.
+func removePeerSections(text string, publicKeys map[string]bool) string {
+	var kept []string
+	var section []string
+	flush := func() {
+		if len(section) == 0 {
+			return
+		}
+		sections := parseWireguardConfig(strings.Join(section, "\n"))
+		if len(sections) == 1 && sections[0].Name == "Peer" && publicKeys[sections[0].Values["PublicKey"]] {
+			end := len(section)
+			for end > 0 {
+				line := strings.TrimSpace(section[end-1])
+				if line != "" && !strings.HasPrefix(line, "#") {
+					break
+				}
+				end--
+			}
+			section = section[end:]
+		}
+		kept = append(kept, section...)
+		section = nil
+	}
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]") {
+			flush()
+		}
+		section = append(section, line)
+	}
+	flush()
+	return strings.Join(kept, "\n")
+}
+
+// importPeers adopts or adds the candidates as managed peers. Peers already on their interface keep their keys and address,
+// their config file sections are rewritten to the format suspending and deleting expects. Other peers get a free address
+// and a preshared key if they have none. Every interface is written and synced once.
+func importPeers(candidates []*Peer, source string, options ImportOptions) ([]ImportResult, error) {
+	if options.Role == "" {
+		options.Role = "user"
+	}
+	if options.Role != "user" && options.Role != "distributor" && options.Role != "admin" {
+		return nil, fmt.Errorf("unknown role %q", options.Role)
+	}
+	if options.Prefix == "" {
+		options.Prefix = "imported"
+	}
+	if err := validatePeerName(fmt.Sprintf("%s-%d", options.Prefix, len(candidates))); err != nil {
+		return nil, fmt.Errorf("prefix: %s", err)
+	}
+	days, allowedUsage := uint64(30), uint64(50*gigabyte)
+	var clientSettings *ClientSettings
+	if options.Plan != nil {
+		days, allowedUsage, clientSettings = options.Plan.Days, options.Plan.AllowedUsage, options.Plan.ClientSettings
+	}
+	if options.Days != 0 {
+		days = options.Days
+	}
+	if options.AllowedUsage != 0 {
+		allowedUsage = options.AllowedUsage
+	}
+	if options.Interface == "" && options.Plan != nil {
+		options.Interface = options.Plan.Interface
+	}
+
+	results := make([]ImportResult, len(candidates))
+	byInterface := map[*Interface][]int{}
+	var interfaces []*Interface
+	for i, p := range candidates {
+		name := p.Interface
+		if name == "" {
+			name = options.Interface
+		}
+		iface := findInterface(name)
+		if iface == nil {
+			results[i] = ImportResult{Name: p.Name, PublicKey: p.PublicKey, Interface: name, Status: "failed", Reason: "interface not found"}
+			continue
+		}
+		if byInterface[iface] == nil {
+			interfaces = append(interfaces, iface)
+		}
+		byInterface[iface] = append(byInterface[iface], i)
+	}
+
+	names := map[string]bool{}
+	publicKeys := map[string]bool{}
+	placeholder := 0
+	for _, iface := range interfaces {
+		network, err := netip.ParsePrefix(iface.NetworkAddress)
+		if err != nil {
+			return nil, fmt.Errorf("interface %s: invalid network address %s", iface.Name, iface.NetworkAddress)
+		}
+		configBytes, err := os.ReadFile(iface.ConfigPath())
+		if err != nil {
+			return nil, err
+		}
+		configText := string(configBytes)
+		live := livePeers(iface, configText)
+		used := map[netip.Addr]bool{network.Addr(): true}
+		for _, p := range config.Peers {
+			if a, err := netip.ParseAddr(p.Address); err == nil && peerInterface(p) == iface {
+				used[a] = true
+			}
+		}
+		for _, l := range live {
+			for _, prefix := range splitList(l.allowedIPs) {
+				if a, ok := singleAddress(prefix); ok {
+					used[a] = true
+				}
+			}
+		}
+
+		var accepted []*Peer
+		replaced := map[string]bool{}
+		for _, i := range byInterface[iface] {
+			p := candidates[i]
+			result := &results[i]
+			*result = ImportResult{Name: p.Name, PublicKey: p.PublicKey, Interface: iface.Name, Status: "failed"}
+
+			if p.PrivateKey != "" {
+				publicKey, err := wgPubkey(p.PrivateKey)
+				if err != nil {
+					result.Reason = "invalid private key"
+					continue
+				}
+				if p.PublicKey != "" && p.PublicKey != publicKey {
+					result.Reason = "public key doesn't match the private key"
+					continue
+				}
+				p.PublicKey = publicKey
+				result.PublicKey = publicKey
+			}
+			if p.PublicKey == "" {
+				result.Reason = "no public or private key"
+				continue
+			}
+			if config.Peers[p.PublicKey] != nil {
+				result.Status = "skipped"
+				result.Reason = "already managed as " + config.Peers[p.PublicKey].Name
+				continue
+			}
+			if owner := retiredKeyOwner(p.PublicKey); owner != nil {
+				result.Status = "skipped"
+				result.Reason = "old key of " + owner.Name + ", still valid after a key rotation"
+				continue
+			}
+			if config.Trash[p.PublicKey] != nil {
+				result.Status = "skipped"
+				result.Reason = "in the trash as " + config.Trash[p.PublicKey].Name + ", restore it instead"
+				continue
+			}
+			if publicKeys[p.PublicKey] {
+				result.Status = "skipped"
+				result.Reason = "listed twice"
+				continue
+			}
+
+			// names from other tools can have spaces and other characters that don't work in urls and telegram buttons
+			if p.Name != "" && validatePeerName(p.Name) != nil {
+				original := p.Name
+				p.Name = sanitizePeerName(original)
+				result.Name = p.Name
+				result.Reason = fmt.Sprintf("renamed from %q, which isn't a valid name", original)
+				if p.Name == "" {
+					result.Reason = fmt.Sprintf("given a placeholder name, %q has no letters or digits to keep", original)
+				}
+			}
+			if p.Name != "" && (findPeerByName(p.Name) != nil || names[p.Name]) {
+				result.Reason = "name is taken"
+				continue
+			}
+
+			if l, ok := live[p.PublicKey]; ok {
+				// the peer is connected with these keys and address, changing them would cut it off
+				if l.presharedKey == "" {
+					result.Reason = "has no preshared key, which suspending needs; add one to the client and the interface and import again"
+					continue
+				}
+				if p.PresharedKey != "" && p.PresharedKey != l.presharedKey {
+					result.Reason = "preshared key doesn't match the interface's"
+					continue
+				}
+				address, ok := singleAddress(l.allowedIPs)
+				if !ok || !network.Contains(address) {
+					result.Reason = fmt.Sprintf("allowed ips %q aren't a single address in %s", l.allowedIPs, network.Masked())
+					continue
+				}
+				if p.Address != "" && p.Address != address.String() && p.Address != address.String()+"/32" {
+					result.Reason = fmt.Sprintf("address %s doesn't match the interface's %s", p.Address, address)
+					continue
+				}
+				p.PresharedKey = l.presharedKey
+				p.Address = address.String()
+				replaced[p.PublicKey] = true
+			} else {
+				if p.PresharedKey == "" {
+					result.NewPresharedKey = true
+					if !options.DryRun {
+						psk, err := exec.Command("wg", "genpsk").Output()
+						if err != nil {
+							result.Reason = "could not generate a preshared key: " + err.Error()
+							continue
+						}
+						p.PresharedKey = strings.TrimSpace(string(psk))
+					}
+				}
+				// keep the old address when it is free on this interface
+				address, err := netip.ParseAddr(strings.TrimSuffix(p.Address, "/32"))
+				if err != nil || !network.Contains(address) || used[address] {
+					if address, err = nextFreeAddress(network, used); err != nil {
+						result.Reason = err.Error()
+						continue
+					}
+				}
+				p.Address = address.String()
+				used[address] = true
+			}
+
+			// placeholder names are only handed out to peers that are imported so they stay consecutive
+			if p.Name == "" {
+				for {
+					placeholder++
+					p.Name = fmt.Sprintf("%s-%d", options.Prefix, placeholder)
+					if findPeerByName(p.Name) == nil && !names[p.Name] {
+						break
+					}
+				}
+				result.Name = p.Name
+			}
+			names[p.Name] = true
+			publicKeys[p.PublicKey] = true
+			p.ID = primitive.NewObjectID()
+			p.Interface = iface.Name
+			if p.ExpiresAt == 0 {
+				p.ExpiresAt = uint64(time.Now().Unix()) + days*86400
+			}
+			if p.AllowedUsage == 0 {
+				p.AllowedUsage = allowedUsage
+			}
+			if p.Role == "" {
+				p.Role = options.Role
+			}
+			if p.ClientSettings == nil {
+				p.ClientSettings = clientSettings
+			}
+			p.TelegramToken = uuid.New().String()
+			p.TelegramChatIDs = []int64{}
+			p.ImportedFrom = source
+			result.Address = p.Address
+			result.Status = "ok"
+			accepted = append(accepted, p)
+		}
+		if options.DryRun || len(accepted) == 0 {
+			continue
+		}
+
+		// rewrite the interface's config file once with the peers in the managed format, in place of the live sections
+		// they replace
+		writePeers := func(peers []*Peer) error {
+			remove := map[string]bool{}
+			sections := ""
+			for _, p := range peers {
+				remove[p.PublicKey] = replaced[p.PublicKey]
+				sections += fmt.Sprintf("\n[Peer]\nPublicKey = %s\nPresharedKey = %s\nAllowedIPs = %s\n", p.PublicKey, p.PresharedKey, p.Address)
+			}
+			newConfig := strings.TrimRight(removePeerSections(configText, remove), "\n") + "\n" + sections
+			if err := os.WriteFile(iface.ConfigPath(), []byte(newConfig), 0644); err != nil {
+				return err
+			}
+			return iface.Sync()
+		}
+		if err = writePeers(accepted); err != nil {
+			return nil, err
+		}
+
+		imported := map[string]bool{}
+		var stored []*Peer
+		for _, p := range accepted {
+			result := &results[slices.Index(candidates, p)]
+			if _, err := config.Collection.InsertOne(context.TODO(), p); err != nil {
+				result.Status = "failed"
+				result.Reason = err.Error()
+				continue
+			}
+			config.Peers[p.PublicKey] = p
+			imported[p.PublicKey] = true
+			stored = append(stored, p)
+			result.Status = "imported"
+			slog.Info("imported peer", peerLog(p), "from", source, "interface", p.Interface, "address", p.Address)
+			emitWebhook(webhookPeerCreated, p, map[string]interface{}{"importedFrom": source})
+		}
+		// peers that couldn't be stored come off the interface again, live peers keep their old section
+		if len(stored) < len(accepted) {
+			if err = writePeers(stored); err != nil {
+				slog.Error("could not remove peers that failed to import", "interface", iface.Name, "error", err)
+			}
+		}
+		// transfer from before the import isn't usage
+		loadTransferCounters(imported)
+	}
+	return results, nil
+}
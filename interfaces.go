@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+type Interface struct {
+	Name string `json:"name"`
+	// Endpoint is the host clients connect to, the listen port is appended when it has none
+	Endpoint string `json:"endpoint"`
+	// PublicKey, NetworkAddress and ListenPort are read from the interface, values set in config.json must match it
+	PublicKey      string `json:"publicKey"`
+	NetworkAddress string `json:"networkAddress"`
+	ListenPort     int    `json:"listenPort"`
+	// DNSServers defaults to the global dnsServers when empty
+	DNSServers string `json:"dnsServers"`
+}
+
+// findInterface returns the interface with the given name, an empty name selects the first interface
+func findInterface(name string) *Interface {
+	if name == "" && len(config.Interfaces) > 0 {
+		return config.Interfaces[0]
+	}
+	for _, i := range config.Interfaces {
+		if i.Name == name {
+			return i
+		}
+	}
+	return nil
+}
+
+// peerInterface returns the interface the peer is bound to, peers created before interfaces were configurable belong to the first one
+func peerInterface(peer *Peer) *Interface {
+	if i := findInterface(peer.Interface); i != nil {
+		return i
+	}
+	return config.Interfaces[0]
+}
+
+func (i *Interface) ConfigPath() string {
+	return fmt.Sprintf("/etc/wireguard/%s.conf", i.Name)
+}
+
+// Sync applies the interface's config file in /etc/wireguard to the running device
+func (i *Interface) Sync() error {
+	// get striped config
+	cmd := exec.Command("wg-quick", "strip", i.Name)
+	configBytes, err := cmd.Output()
+	if err != nil {
+		return err
+	}
+
+	// write striped config to a file
+	err = os.WriteFile(config.Path+"/"+i.Name+".conf", configBytes, 0644)
+	if err != nil {
+		return err
+	}
+
+	// save chagnes to main config file
+	cmd = exec.Command("wg", "syncconf", i.Name, fmt.Sprintf("%s/%s.conf", config.Path, i.Name))
+	_, err = cmd.Output()
+	return err
+}
+
+// Dump returns the `wg show dump` line of every peer on the interface
+func (i *Interface) Dump() ([]string, error) {
+	cmd := exec.Command("wg", "show", i.Name, "dump")
+	bytes, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	// each line contains a peer's info, excluding the first line whichis the interface info
+	return strings.Split(strings.TrimSpace(string(bytes)), "\n")[1:], nil
+}
+
+// WireguardSection is one [Interface] or [Peer] section of a wireguard config file, repeated keys are joined with commas
+type WireguardSection struct {
+	Name   string
+	Values map[string]string
+}
+
+func parseWireguardConfig(text string) []WireguardSection {
+	var sections []WireguardSection
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(strings.SplitN(line, "#", 2)[0])
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			sections = append(sections, WireguardSection{Name: strings.Trim(line, "[]"), Values: map[string]string{}})
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		if !found || len(sections) == 0 {
+			continue
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+		values := sections[len(sections)-1].Values
+		if values[key] != "" {
+			values[key] += ", " + value
+		} else {
+			values[key] = value
+		}
+	}
+	return sections
+}
+
+// wgPubkey derives the public key of a wireguard private key
+func wgPubkey(privateKey string) (string, error) {
+	cmd := exec.Command("wg", "pubkey")
+	cmd.Stdin = strings.NewReader(privateKey)
+	publicKeyBytes, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(publicKeyBytes)), nil
+}
+
+// Detect reads the public key, network address and listen port from the interface's config file and the live device,
+// and fails if the values set in config.json don't match them
+func (i *Interface) Detect() error {
+	var publicKey, networkAddress string
+	var listenPort int
+
+	// read config file
+	configBytes, err := os.ReadFile(i.ConfigPath())
+	if err != nil {
+		return fmt.Errorf("interface %s: %s", i.Name, err)
+	}
+	for _, section := range parseWireguardConfig(string(configBytes)) {
+		if section.Name != "Interface" {
+			continue
+		}
+		for _, address := range splitList(section.Values["Address"]) {
+			if p, err := netip.ParsePrefix(address); err == nil && p.Addr().Is4() {
+				networkAddress = p.String()
+				break
+			}
+		}
+		listenPort, _ = strconv.Atoi(section.Values["ListenPort"])
+		if section.Values["PrivateKey"] != "" {
+			if publicKey, err = wgPubkey(section.Values["PrivateKey"]); err != nil {
+				return fmt.Errorf("interface %s: could not derive public key: %s", i.Name, err)
+			}
+		}
+	}
+
+	// the running device has the final say on the key and port
+	cmd := exec.Command("wg", "show", i.Name, "dump")
+	if dump, err := cmd.Output(); err == nil {
+		info := strings.Split(strings.Split(strings.TrimSpace(string(dump)), "\n")[0], "\t")
+		if len(info) >= 3 {
+			publicKey = info[1]
+			listenPort, _ = strconv.Atoi(info[2])
+		}
+	}
+
+	if publicKey == "" || networkAddress == "" {
+		return fmt.Errorf("interface %s: could not read public key and ipv4 address from %s or the running device", i.Name, i.ConfigPath())
+	}
+
+	// compare with config.json
+	if i.PublicKey != "" && i.PublicKey != publicKey {
+		return fmt.Errorf("interface %s: public key %s in config.json does not match the interface's %s", i.Name, i.PublicKey, publicKey)
+	}
+	// the interface's own address and the network's address both name the network, only the masked prefixes are compared
+	if i.NetworkAddress != "" {
+		configured, err := netip.ParsePrefix(i.NetworkAddress)
+		if err != nil || configured.Masked() != netip.MustParsePrefix(networkAddress).Masked() {
+			return fmt.Errorf("interface %s: network address %s in config.json does not match the interface's %s", i.Name, i.NetworkAddress, networkAddress)
+		}
+	}
+	if i.ListenPort != 0 && i.ListenPort != listenPort {
+		return fmt.Errorf("interface %s: listen port %d in config.json does not match the interface's %d", i.Name, i.ListenPort, listenPort)
+	}
+	if i.Endpoint == "" {
+		return fmt.Errorf("interface %s: endpoint is required", i.Name)
+	}
+	if _, port, err := net.SplitHostPort(i.Endpoint); err != nil {
+		if listenPort == 0 {
+			return fmt.Errorf("interface %s: endpoint has no port and the interface has no listen port", i.Name)
+		}
+		i.Endpoint = net.JoinHostPort(i.Endpoint, strconv.Itoa(listenPort))
+	} else if listenPort != 0 && port != strconv.Itoa(listenPort) {
+		slog.Warn("endpoint port differs from listen port, assuming port forwarding", "interface", i.Name, "endpointPort", port, "listenPort", listenPort)
+	}
+
+	i.PublicKey = publicKey
+	i.NetworkAddress = networkAddress
+	i.ListenPort = listenPort
+	return nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"path/filepath"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+type HTTPConfig struct {
+	// Address is where the dashboard is served over plain http, defaults to ":80"
+	Address string `json:"address"`
+	// TLSAddress is where the dashboard is served over https when TLS is enabled, defaults to ":443"
+	TLSAddress string `json:"tlsAddress"`
+	// CertFile and KeyFile enable TLS with a certificate from disk
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+	// ACMEDomains enables TLS with certificates from Let's Encrypt for the listed domains
+	ACMEDomains  []string `json:"acmeDomains"`
+	ACMECacheDir string   `json:"acmeCacheDir"`
+	// RedirectHTTP answers plain http requests with a redirect to https when TLS is enabled
+	RedirectHTTP bool `json:"redirectHTTP"`
+	// TunnelOnly binds the listeners to the server's address on every wireguard interface so the dashboard is only reachable through the tunnel
+	TunnelOnly bool `json:"tunnelOnly"`
+}
+
+// httpServers are the running dashboard listeners
+var httpServers []*http.Server
+
+func (h *HTTPConfig) setDefaults(path string) {
+	if h.Address == "" {
+		h.Address = ":80"
+	}
+	if h.TLSAddress == "" {
+		h.TLSAddress = ":443"
+	}
+	if h.ACMECacheDir == "" {
+		h.ACMECacheDir = filepath.Join(path, "acme-cache")
+	}
+}
+
+func (h *HTTPConfig) tlsEnabled() bool {
+	return h.CertFile != "" || len(h.ACMEDomains) > 0
+}
+
+func (h *HTTPConfig) validate() []error {
+	var problems []error
+	for _, address := range []string{h.Address, h.TLSAddress} {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			problems = append(problems, fmt.Errorf("http: invalid listen address %q", address))
+		}
+	}
+	if (h.CertFile == "") != (h.KeyFile == "") {
+		problems = append(problems, errors.New("http: certFile and keyFile must be set together"))
+	} else if h.CertFile != "" {
+		if _, err := tls.LoadX509KeyPair(h.CertFile, h.KeyFile); err != nil {
+			problems = append(problems, fmt.Errorf("http: %s", err))
+		}
+		if len(h.ACMEDomains) > 0 {
+			problems = append(problems, errors.New("http: use either certFile and keyFile or acmeDomains"))
+		}
+	}
+	if len(h.ACMEDomains) > 0 && h.TunnelOnly {
+		problems = append(problems, errors.New("http: acmeDomains needs public listeners and can't be used with tunnelOnly"))
+	}
+	if h.RedirectHTTP && !h.tlsEnabled() {
+		problems = append(problems, errors.New("http: redirectHTTP needs certFile and keyFile or acmeDomains"))
+	}
+	return problems
+}
+
+// listenAddresses binds address to the server's address on every interface when the dashboard is tunnel only
+func (h *HTTPConfig) listenAddresses(address string) []string {
+	if !h.TunnelOnly {
+		return []string{address}
+	}
+	_, port, _ := net.SplitHostPort(address)
+	var addresses []string
+	for _, iface := range config.Interfaces {
+		prefix, err := netip.ParsePrefix(iface.NetworkAddress)
+		if err != nil {
+			continue
+		}
+		addresses = append(addresses, net.JoinHostPort(prefix.Addr().String(), port))
+	}
+	return addresses
+}
+
+// redirectToHTTPS sends plain http requests to the same host and path over https
+func (h *HTTPConfig) redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	if _, port, _ := net.SplitHostPort(h.TLSAddress); port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
+
+// runHTTPServers serves handler on the configured listeners and returns when one of them fails
+func runHTTPServers(handler http.Handler) error {
+	h := &config.HTTP
+	plain := handler
+	var tlsConfig *tls.Config
+	if len(h.ACMEDomains) > 0 {
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(h.ACMEDomains...),
+			Cache:      autocert.DirCache(h.ACMECacheDir),
+		}
+		tlsConfig = manager.TLSConfig()
+		// the plain listener answers http-01 challenges and passes everything else on
+		if h.RedirectHTTP {
+			plain = manager.HTTPHandler(http.HandlerFunc(h.redirectToHTTPS))
+		} else {
+			plain = manager.HTTPHandler(handler)
+		}
+	} else if h.RedirectHTTP {
+		plain = http.HandlerFunc(h.redirectToHTTPS)
+	}
+
+	// bind every address before serving so the server is only reported ready once all listeners are up
+	type listener struct {
+		server *http.Server
+		ln     net.Listener
+		secure bool
+	}
+	var listeners []listener
+	bind := func(address string, handler http.Handler, secure bool) error {
+		ln, err := net.Listen("tcp", address)
+		if err != nil {
+			return err
+		}
+		server := &http.Server{Addr: address, Handler: handler}
+		if secure {
+			server.TLSConfig = tlsConfig
+		}
+		httpServers = append(httpServers, server)
+		listeners = append(listeners, listener{server, ln, secure})
+		return nil
+	}
+	for _, address := range h.listenAddresses(h.Address) {
+		if err := bind(address, plain, false); err != nil {
+			return err
+		}
+	}
+	if h.tlsEnabled() {
+		for _, address := range h.listenAddresses(h.TLSAddress) {
+			if err := bind(address, handler, true); err != nil {
+				return err
+			}
+		}
+	}
+	if len(listeners) == 0 {
+		return errors.New("no addresses to listen on")
+	}
+
+	errs := make(chan error)
+	for _, l := range listeners {
+		go func(l listener) {
+			if l.secure {
+				slog.Info("listening", "address", "https://"+l.server.Addr)
+				errs <- l.server.ServeTLS(l.ln, h.CertFile, h.KeyFile)
+			} else {
+				slog.Info("listening", "address", "http://"+l.server.Addr)
+				errs <- l.server.Serve(l.ln)
+			}
+		}(l)
+	}
+	sdNotify("READY=1")
+	err := <-errs
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+type LogConfig struct {
+	// Level is debug, info, warn or error, defaults to info
+	Level string `json:"level"`
+	// Format is text or json, defaults to text
+	Format string `json:"format"`
+}
+
+// logLevel can be changed while running, the handler reads it for every record
+var logLevel = new(slog.LevelVar)
+
+func parseLogLevel(level string) (slog.Level, error) {
+	var l slog.Level
+	err := l.UnmarshalText([]byte(level))
+	return l, err
+}
+
+func (l *LogConfig) setDefaults() {
+	if l.Level == "" {
+		l.Level = "info"
+	}
+	if l.Format == "" {
+		l.Format = "text"
+	}
+}
+
+func (l *LogConfig) validate() []error {
+	var problems []error
+	if _, err := parseLogLevel(l.Level); err != nil {
+		problems = append(problems, fmt.Errorf("log: invalid level %q", l.Level))
+	}
+	if l.Format != "text" && l.Format != "json" {
+		problems = append(problems, fmt.Errorf("log: format must be text or json"))
+	}
+	return problems
+}
+
+// setupLogging makes the configured handler the default logger
+func setupLogging(l LogConfig) {
+	level, _ := parseLogLevel(l.Level)
+	logLevel.Set(level)
+	options := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, options)
+	if l.Format == "json" {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+// peerLog groups the fields identifying a peer in log records
+func peerLog(p *Peer) slog.Attr {
+	return slog.Group("peer", "name", p.Name, "publicKey", p.PublicKey)
+}
+
+// requestLogger returns the logger carrying the request's id
+func requestLogger(c *gin.Context) *slog.Logger {
+	if l, ok := c.Get("logger"); ok {
+		return l.(*slog.Logger)
+	}
+	return slog.Default()
+}
+
+// accessLog gives every request an id, taken from X-Request-ID when the client sends one, and logs the request when it is done.
+// Handlers report errors with c.Error so they end up in the request's log record.
+func accessLog(c *gin.Context) {
+	start := time.Now()
+	id := c.GetHeader("X-Request-ID")
+	if id == "" || len(id) > 64 {
+		id = uuid.New().String()
+	}
+	c.Header("X-Request-ID", id)
+	logger := slog.Default().With("requestID", id)
+	c.Set("logger", logger)
+
+	c.Next()
+
+	status := c.Writer.Status()
+	route := c.FullPath()
+	if route == "" {
+		route = c.Request.URL.Path
+	}
+	attrs := []any{
+		"method", c.Request.Method,
+		"route", route,
+		"status", status,
+		"latency", time.Since(start).String(),
+		"remoteAddr", c.ClientIP(),
+	}
+	if actor, _ := requestClient(c); actor != "" {
+		attrs = append(attrs, "actor", actor)
+	}
+	if len(c.Errors) > 0 {
+		attrs = append(attrs, "errors", c.Errors.Errors())
+	}
+
+	level := slog.LevelInfo
+	switch {
+	case status >= 500 || len(c.Errors) > 0:
+		level = slog.LevelError
+	case status >= 400:
+		level = slog.LevelWarn
+	case route == "/healthz" || route == "/readyz" || route == "/ws":
+		level = slog.LevelDebug
+	}
+	logger.Log(c.Request.Context(), level, "request", attrs...)
+}
+
+// recoverPanics logs handler panics with the request's id and answers with 500
+func recoverPanics(c *gin.Context, err any) {
+	requestLogger(c).Error("panic while handling request", "error", err)
+	c.AbortWithStatus(500)
+}
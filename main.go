@@ -1,20 +1,23 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/exec"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gin-contrib/static"
-	"github.com/gin-gonic/autotls"
 	"github.com/gin-gonic/gin"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/google/uuid"
@@ -28,12 +31,15 @@ import (
 var config Config
 
 type Config struct {
-	MongoURI             string `json:"mongoURI"`
-	DBName               string `json:"dbName"`
-	CollectionName       string `json:"collectionName"`
+	MongoURI       string `json:"mongoURI"`
+	DBName         string `json:"dbName"`
+	CollectionName string `json:"collectionName"`
+	// InterfaceName, ServerEndpoint, ServerPublicKey, ServerNetworkAddress are used as the only interface when Interfaces is empty,
+	// the key and address are optional and read from the interface
 	InterfaceName        string `json:"interfaceName"`
 	Collection           *mongo.Collection
 	Peers                map[string]*Peer
+	Trash                map[string]*Peer
 	ServerEndpoint       string `json:"serverEndpoint"`
 	ServerPublicKey      string `json:"serverPublicKey"`
 	ServerNetworkAddress string `json:"serverNetworkAddress"`
@@ -41,7 +47,50 @@ type Config struct {
 	DNSServers           string `json:"dnsServers"`
 	TelegramBotToken     string `json:"telegramBotToken"`
 	TelegramBot          *tgbotapi.BotAPI
-	Domain               string `json:"domain"`
+	HTTP                 HTTPConfig   `json:"http"`
+	Log                  LogConfig    `json:"log"`
+	Plans                []Plan       `json:"plans"`
+	Interfaces           []*Interface `json:"interfaces"`
+	// AgentAddress is the address the node agent API listens on, the agent is disabled when it or AgentToken is empty
+	AgentAddress string `json:"agentAddress"`
+	AgentToken   string `json:"agentToken"`
+	// AgentCertFile and AgentKeyFile serve the node agent over TLS, exports carry private keys
+	AgentCertFile string `json:"agentCertFile"`
+	AgentKeyFile  string `json:"agentKeyFile"`
+	// Nodes are remote servers managed from this instance through their node agents
+	Nodes []*Node `json:"nodes"`
+	// MaxTelegramSubscribers limits how many chats can subscribe to a single peer, zero means no limit
+	MaxTelegramSubscribers int `json:"maxTelegramSubscribers"`
+	// TelegramOperatorSecret is what chats linked to admin and distributor peers send with /operator before they can manage
+	// peers from the bot, the bot manages nothing while it is empty
+	TelegramOperatorSecret string    `json:"telegramOperatorSecret"`
+	Webhooks               []Webhook `json:"webhooks"`
+	// WebhookDeliveriesCollectionName is the collection the webhook delivery log is kept in, defaults to "webhookDeliveries"
+	WebhookDeliveriesCollectionName string `json:"webhookDeliveriesCollectionName"`
+	WebhookDeliveries               *mongo.Collection
+	SMTP                            *SMTPConfig `json:"smtp"`
+	// GroupClientSettings holds client config settings for every peer of a group, keyed by group name
+	GroupClientSettings map[string]ClientSettings `json:"groupClientSettings"`
+	// ExpiryNoticeDays is how many days before expiry peers are notified, defaults to 3
+	ExpiryNoticeDays uint64 `json:"expiryNoticeDays"`
+	// UsageNoticeBytes is the remaining usage that triggers the low usage notice and the quota threshold webhook, defaults to 3 gigabytes
+	UsageNoticeBytes uint64 `json:"usageNoticeBytes"`
+	// MaxUpdateAge is how many seconds may pass since the last peer update before the server isn't ready, defaults to 10
+	MaxUpdateAge int          `json:"maxUpdateAge"`
+	Backup       BackupConfig `json:"backup"`
+	// ClientConfigTemplate is the path of a text/template file used instead of the built-in client config template
+	ClientConfigTemplate string `json:"clientConfigTemplate"`
+	// TrashDays is how many days deleted peers stay in the trash before they are purged, defaults to 30, -1 keeps them until they are purged by hand
+	TrashDays int `json:"trashDays"`
+}
+
+type Plan struct {
+	Name           string          `json:"name"`
+	Days           uint64          `json:"days"`
+	AllowedUsage   uint64          `json:"allowedUsage"`
+	ClientSettings *ClientSettings `json:"clientSettings"`
+	// Interface is the interface peers created from the plan are bound to, defaults to the first interface
+	Interface string `json:"interface"`
 }
 
 type Peer struct {
@@ -51,6 +100,7 @@ type Peer struct {
 	PublicKey                     string             `bson:"publicKey" json:"publicKey"`
 	PresharedKey                  string             `bson:"presharedKey" json:"-"`
 	Address                       string             `bson:"address" json:"address"`
+	Interface                     string             `bson:"interface" json:"interface"`
 	ExpiresAt                     uint64             `bson:"expiresAt" json:"expiresAt"`
 	LatestHandshake               uint64             `bson:"-" json:"latestHandshake"`
 	TotalRx                       uint64             `bson:"-" json:"-"`
@@ -58,15 +108,37 @@ type Peer struct {
 	CurrentRx                     uint64             `bson:"-" json:"currentRx"`
 	CurrentTx                     uint64             `bson:"-" json:"currentTx"`
 	Suspended                     bool               `bson:"suspended" json:"suspended"`
+	Disabled                      bool               `bson:"disabled" json:"disabled"`
 	AllowedUsage                  uint64             `bson:"allowedUsage" json:"allowedUsage"`
 	TotalUsage                    uint64             `bson:"totalUsage" json:"totalUsage"`
 	Role                          string             `bson:"role" json:"role"`
 	TelegramToken                 string             `bson:"telegramToken" json:"telegramToken"`
-	TelegramChatID                int64              `bson:"telegramChatID" json:"-"`
+	Email                         string             `bson:"email" json:"email"`
+	ClientSettings                *ClientSettings    `bson:"clientSettings,omitempty" json:"clientSettings,omitempty"`
+	TelegramChatIDs               []int64            `bson:"telegramChatIDs" json:"-"`
+	LegacyTelegramChatID          int64              `bson:"telegramChatID,omitempty" json:"-"`
 	ReceivedThreeDaysNotification bool               `bson:"receivedThreeDaysNotification" json:"-"`
 	ReceivedThreeGigsNotification bool               `bson:"receivedThreeGigsNotification" json:"-"`
+	Tags                          []string           `bson:"tags,omitempty" json:"tags,omitempty"`
+	// ImportedFrom is the source of peers that were imported instead of created, see importPeers
+	ImportedFrom string `bson:"importedFrom,omitempty" json:"importedFrom,omitempty"`
+	// DeletedAt and DeletedBy are set while the peer is in the trash, see trashPeer
+	DeletedAt uint64 `bson:"deletedAt,omitempty" json:"deletedAt,omitempty"`
+	DeletedBy string `bson:"deletedBy,omitempty" json:"deletedBy,omitempty"`
+	// NameHistory lists the peer's renames, oldest first
+	NameHistory []NameChange `bson:"nameHistory,omitempty" json:"nameHistory,omitempty"`
+	// RetiredKey is the keypair the peer had before its keys were rotated while its grace period lasts, see rotatePeerKeys
+	RetiredKey *RetiredKey `bson:"retiredKey,omitempty" json:"retiredKey,omitempty"`
+	// DisabledReason, DisabledAt and DisabledBy say why, when and by whom a disabled peer was suspended by hand
+	DisabledReason string `bson:"disabledReason,omitempty" json:"disabledReason,omitempty"`
+	DisabledAt     uint64 `bson:"disabledAt,omitempty" json:"disabledAt,omitempty"`
+	DisabledBy     string `bson:"disabledBy,omitempty" json:"disabledBy,omitempty"`
+	// TelegramOperatorChatIDs are the linked chats that sent the operator secret, see handleTelegramOperator
+	TelegramOperatorChatIDs []int64 `bson:"telegramOperatorChatIDs,omitempty" json:"-"`
 }
 
+const gigabyte = 1024000000
+
 type IPAddress struct {
 	Octets [4]int
 }
@@ -105,30 +177,39 @@ func (a *IPAddress) Parse(address string) {
 	}
 }
 
-func createPeer(name string, role string) (*Peer, error) {
-	// check if name is already taken
-	for _, peer := range config.Peers {
-		if name == peer.Name {
-			return nil, errors.New("duplicate name")
-		}
+// createPeer creates a peer on the named interface with the plan's duration and data limit, or 30 days and 50 gigabytes if plan is nil.
+// An empty interface name selects the plan's interface or the first one.
+func createPeer(name string, role string, interfaceName string, plan *Plan) (*Peer, error) {
+	peer, err := newPeer(name, role, interfaceName, plan)
+	if err != nil {
+		return nil, err
+	}
+	if err = addPeer(peer); err != nil {
+		return nil, err
 	}
+	return peer, nil
+}
 
-	// find unused network address for peer
-	var a IPAddress
-	a.Parse(strings.Split(config.ServerNetworkAddress, "/")[0])
-	a.Increment()
-	cmd := exec.Command("wg-quick", "strip", config.InterfaceName)
-	allPeersBytes, err := cmd.Output()
-	if err != nil {
+// newPeer generates the keys and settings of a peer without adding it anywhere
+func newPeer(name string, role string, interfaceName string, plan *Plan) (*Peer, error) {
+	if err := validatePeerName(name); err != nil {
 		return nil, err
 	}
-	allPeers := string(allPeersBytes)
-	for strings.Contains(allPeers, a.ToString()) {
-		a.Increment()
+	// check if name is already taken
+	if findPeerByName(name) != nil {
+		return nil, errors.New("duplicate name")
+	}
+
+	if interfaceName == "" && plan != nil {
+		interfaceName = plan.Interface
+	}
+	iface := findInterface(interfaceName)
+	if iface == nil {
+		return nil, errors.New("interface not found")
 	}
 
 	// create private key
-	cmd = exec.Command("wg", "genkey")
+	cmd := exec.Command("wg", "genkey")
 	privateKeyBytes, err := cmd.Output()
 	if err != nil {
 		return nil, err
@@ -136,18 +217,10 @@ func createPeer(name string, role string) (*Peer, error) {
 	clientPrivateKey := strings.TrimSpace(string(privateKeyBytes))
 
 	// create publick key
-	echoCommand := exec.Command("echo", clientPrivateKey)
-	genkeyCommand := exec.Command("wg", "pubkey")
-	genkeyCommand.Stdin, _ = echoCommand.StdoutPipe()
-	err = echoCommand.Start()
-	if err != nil {
-		return nil, err
-	}
-	publicKeyBytes, err := genkeyCommand.Output()
+	clientPublicKey, err := wgPubkey(clientPrivateKey)
 	if err != nil {
 		return nil, err
 	}
-	clientPublicKey := strings.TrimSpace(string(publicKeyBytes))
 
 	// create preshared key
 	cmd = exec.Command("wg", "genpsk")
@@ -160,108 +233,289 @@ func createPeer(name string, role string) (*Peer, error) {
 	// create telegram token
 	tt := uuid.New().String()
 
-	// add peer
-	config.Peers[clientPublicKey] = &Peer{
-		ID:             primitive.NewObjectID(),
-		Name:           name,
-		PublicKey:      clientPublicKey,
-		PrivateKey:     clientPrivateKey,
-		PresharedKey:   presharedKey,
-		Address:        a.ToString(),
-		ExpiresAt:      uint64(time.Now().Unix() + 60*60*24*30),
-		AllowedUsage:   50 * 1024000000,
-		Role:           role,
-		TelegramToken:  tt,
-		TelegramChatID: 0,
+	expiresAt := uint64(time.Now().Unix() + 60*60*24*30)
+	allowedUsage := uint64(50 * 1024000000)
+	var clientSettings *ClientSettings
+	if plan != nil {
+		expiresAt = uint64(time.Now().Unix()) + plan.Days*86400
+		allowedUsage = plan.AllowedUsage
+		clientSettings = plan.ClientSettings
 	}
 
-	// update config file
-	f, err := os.OpenFile(fmt.Sprintf("/etc/wireguard/%s.conf", config.InterfaceName), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	peer := &Peer{
+		ID:              primitive.NewObjectID(),
+		Name:            name,
+		PublicKey:       clientPublicKey,
+		PrivateKey:      clientPrivateKey,
+		PresharedKey:    presharedKey,
+		Interface:       iface.Name,
+		ExpiresAt:       expiresAt,
+		AllowedUsage:    allowedUsage,
+		Role:            role,
+		TelegramToken:   tt,
+		TelegramChatIDs: []int64{},
+		ClientSettings:  clientSettings,
+	}
+	return peer, nil
+}
+
+// addPeer gives a peer that already has its keys an unused address on its interface, adds it to the device and stores it
+func addPeer(peer *Peer) error {
+	iface, err := appendPeerConfig(peer)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if _, err := f.Write([]byte(fmt.Sprintf("\n[Peer]\nPublicKey = %s\nPresharedKey = %s\nAllowedIPs = %s\n", clientPublicKey, presharedKey, a.ToString()))); err != nil {
-		return nil, err
+	if err := iface.Sync(); err != nil {
+		return err
 	}
-	if err := f.Close(); err != nil {
-		return nil, err
+	return storeNewPeer(peer)
+}
+
+// appendPeerConfig gives the peer an unused address on its interface, unless the address it has is still free,
+// and adds it to the interface's config file. The device only gets the peer once the interface is synced.
+func appendPeerConfig(peer *Peer) (*Interface, error) {
+	// check if name or key is already taken
+	if findPeerByName(peer.Name) != nil {
+		return nil, errors.New("duplicate name")
+	}
+	if config.Peers[peer.PublicKey] != nil {
+		return nil, errors.New("duplicate public key")
 	}
+	if trashed := config.Trash[peer.PublicKey]; trashed != nil && trashed != peer {
+		return nil, fmt.Errorf("public key belongs to %s in the trash", trashed.Name)
+	}
+	iface := findInterface(peer.Interface)
+	if iface == nil {
+		return nil, errors.New("interface not found")
+	}
+	peer.Interface = iface.Name
 
-	// get striped config
-	cmd = exec.Command("wg-quick", "strip", config.InterfaceName)
-	configBytes, err := cmd.Output()
+	// restored peers keep their address if no other peer took it meanwhile
+	address, err := unusedAddress(iface, peer.Address)
 	if err != nil {
 		return nil, err
 	}
+	peer.Address = address
 
-	// write striped config to a file
-	err = os.WriteFile(config.Path+"/"+config.InterfaceName+".conf", configBytes, 0644)
+	// update config file
+	f, err := os.OpenFile(iface.ConfigPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	if _, err := f.Write([]byte(fmt.Sprintf("\n[Peer]\nPublicKey = %s\nPresharedKey = %s\nAllowedIPs = %s\n", peer.PublicKey, peer.PresharedKey, peer.Address))); err != nil {
+		return nil, err
+	}
+	return iface, f.Close()
+}
 
-	// save chagnes to main config file
-	cmd = exec.Command("wg", "syncconf", config.InterfaceName, fmt.Sprintf("%s/%s.conf", config.Path, config.InterfaceName))
-	_, err = cmd.Output()
+// unusedAddress returns keep if no peer of the interface uses it, and the first unused network address otherwise
+func unusedAddress(iface *Interface, keep string) (string, error) {
+	cmd := exec.Command("wg-quick", "strip", iface.Name)
+	allPeersBytes, err := cmd.Output()
 	if err != nil {
-		return nil, err
+		return "", err
+	}
+	allPeers := string(allPeersBytes)
+	if keep != "" && !strings.Contains(allPeers, keep) {
+		return keep, nil
+	}
+	var a IPAddress
+	a.Parse(strings.Split(iface.NetworkAddress, "/")[0])
+	a.Increment()
+	for strings.Contains(allPeers, a.ToString()) {
+		a.Increment()
 	}
+	return a.ToString(), nil
+}
 
-	// add peer to database
-	_, err = config.Collection.InsertOne(context.TODO(), config.Peers[clientPublicKey])
+// storeNewPeer adds a peer that is already on its interface to the peers in memory and the database
+func storeNewPeer(peer *Peer) error {
+	config.Peers[peer.PublicKey] = peer
+	_, err := config.Collection.InsertOne(context.TODO(), peer)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return config.Peers[clientPublicKey], nil
+	slog.Info("created peer", peerLog(peer), "interface", peer.Interface, "address", peer.Address)
+	emitWebhook(webhookPeerCreated, peer, nil)
+	return nil
 }
 
-func deletePeer(name string) error {
+// deletePeer takes the peer off its interface and moves it to the trash, or deletes it for good when purge is set
+func deletePeer(name string, actor string, purge bool) error {
 	peer := findPeerByName(name)
 	if peer == nil {
 		return errors.New("peer not found")
 	}
-	configBytes, err := os.ReadFile(fmt.Sprintf("/etc/wireguard/%s.conf", config.InterfaceName))
+	if !purge {
+		if err := canTrashPeer(peer); err != nil {
+			return err
+		}
+	}
+	iface, err := removePeerConfig(peer)
 	if err != nil {
 		return err
 	}
+	if err = iface.Sync(); err != nil {
+		return err
+	}
+	if purge {
+		return forgetPeer(peer)
+	}
+	return trashPeer(peer, actor)
+}
 
-	newConfig := strings.Replace(
-		string(configBytes),
-		fmt.Sprintf("\n[Peer]\nPublicKey = %s\nPresharedKey = %s\nAllowedIPs = %s\n", peer.PublicKey, peer.PresharedKey, peer.Address),
-		"",
-		1,
-	)
-
-	err = os.WriteFile(fmt.Sprintf("/etc/wireguard/%s.conf", config.InterfaceName), []byte(newConfig), 0644)
+// removePeerConfig removes the peer from its interface's config file, the device drops it once the interface is synced
+func removePeerConfig(peer *Peer) (*Interface, error) {
+	iface := peerInterface(peer)
+	configBytes, err := os.ReadFile(iface.ConfigPath())
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	// match the section by key, suspended peers have another preshared key in the file
+	publicKeys := map[string]bool{peer.PublicKey: true}
+	if peer.RetiredKey != nil {
+		publicKeys[peer.RetiredKey.PublicKey] = true
 	}
+	newConfig := removePeerSections(string(configBytes), publicKeys)
 
-	_, err = config.Collection.DeleteOne(
+	return iface, os.WriteFile(iface.ConfigPath(), []byte(newConfig), 0644)
+}
+
+// forgetPeer deletes a peer that is no longer on its interface from the database and memory
+func forgetPeer(peer *Peer) error {
+	_, err := config.Collection.DeleteOne(
 		context.TODO(),
-		bson.M{"name": name},
+		bson.M{"publicKey": peer.PublicKey},
 	)
 
 	if err == nil {
 		delete(config.Peers, peer.PublicKey)
+		slog.Info("deleted peer", peerLog(peer))
+		emitWebhook(webhookPeerDeleted, peer, nil)
 	}
 
 	return err
 }
 
-func updatePeers() {
-	// get peers info from wg
-	cmd := exec.Command("wg", "show", config.InterfaceName, "dump")
-	bytes, err := cmd.Output()
+func findPlan(name string) *Plan {
+	for i := range config.Plans {
+		if config.Plans[i].Name == name {
+			return &config.Plans[i]
+		}
+	}
+	return nil
+}
+
+// extendPeer adds days to the peer's expiry, counting from now if it has already expired
+func extendPeer(peer *Peer, days uint64) error {
+	now := uint64(time.Now().Unix())
+	if peer.ExpiresAt < now {
+		peer.ExpiresAt = now
+	}
+	peer.ExpiresAt += days * 86400
+	update := bson.M{"expiresAt": peer.ExpiresAt}
+	if peer.ExpiresAt-now > config.ExpiryNoticeDays*86400 {
+		peer.ReceivedThreeDaysNotification = false
+		update["receivedThreeDaysNotification"] = false
+	}
+	_, err := config.Collection.UpdateOne(context.TODO(), bson.M{"publicKey": peer.PublicKey}, bson.M{"$set": update})
+	if err == nil {
+		slog.Info("extended peer", peerLog(peer), "days", days, "expiresAt", peer.ExpiresAt)
+		emitWebhook(webhookPeerExtended, peer, map[string]interface{}{"days": days})
+	}
+	return err
+}
+
+// addPeerUsage raises the peer's allowed usage by the given amount of bytes
+func addPeerUsage(peer *Peer, bytes uint64) error {
+	peer.AllowedUsage += bytes
+	update := bson.M{"allowedUsage": peer.AllowedUsage}
+	if peer.AllowedUsage > peer.TotalUsage+config.UsageNoticeBytes {
+		peer.ReceivedThreeGigsNotification = false
+		update["receivedThreeGigsNotification"] = false
+	}
+	_, err := config.Collection.UpdateOne(context.TODO(), bson.M{"publicKey": peer.PublicKey}, bson.M{"$set": update})
+	if err == nil {
+		slog.Info("added usage to peer", peerLog(peer), "bytes", bytes, "allowedUsage", peer.AllowedUsage)
+		emitWebhook(webhookPeerExtended, peer, map[string]interface{}{"bytes": bytes})
+	}
+	return err
+}
+
+func setPeerEmail(peer *Peer, email string) error {
+	email, err := validateEmail(email)
+	if err != nil {
+		return err
+	}
+	_, err = config.Collection.UpdateOne(context.TODO(), bson.M{"publicKey": peer.PublicKey}, bson.M{"$set": bson.M{"email": email}})
+	if err == nil {
+		peer.Email = email
+	}
+	return err
+}
+
+func resetPeerUsage(peer *Peer) error {
+	discardQueuedUsage(peer)
+	peer.TotalUsage = 0
+	peer.ReceivedThreeGigsNotification = false
+	_, err := config.Collection.UpdateOne(
+		context.TODO(),
+		bson.M{"publicKey": peer.PublicKey},
+		bson.M{"$set": bson.M{"totalUsage": 0, "receivedThreeGigsNotification": false}})
+	if err == nil {
+		slog.Info("reset peer usage", peerLog(peer))
+		emitWebhook(webhookPeerUsageReset, peer, nil)
+	}
+	return err
+}
+
+// setPeerDisabled marks the peer as disabled or enabled, updatePeers suspends or revives it on its next run.
+// A disabled peer stays suspended whatever its expiry and usage until it is enabled again.
+func setPeerDisabled(peer *Peer, disabled bool, reason string, actor string) error {
+	now := uint64(time.Now().Unix())
+	update := bson.M{"$set": bson.M{"disabled": disabled, "disabledReason": reason, "disabledAt": now, "disabledBy": actor}}
+	if !disabled {
+		update = bson.M{"$set": bson.M{"disabled": false}, "$unset": bson.M{"disabledReason": "", "disabledAt": "", "disabledBy": ""}}
+	}
+	_, err := config.Collection.UpdateOne(context.TODO(), bson.M{"publicKey": peer.PublicKey}, update)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return err
+	}
+	peer.Disabled = disabled
+	peer.DisabledReason, peer.DisabledAt, peer.DisabledBy = "", 0, ""
+	if disabled {
+		peer.DisabledReason, peer.DisabledAt, peer.DisabledBy = reason, now, actor
+	}
+	slog.Info("changed peer state", peerLog(peer), "disabled", disabled, "reason", reason, "actor", actor)
+	return nil
+}
+
+// applyPeerState suspends or revives the peer right away when its state changed, instead of waiting for updatePeers.
+// The caller holds updateMutex.
+func applyPeerState(peer *Peer) error {
+	batch := &bulkBatch{pending: map[*Interface][]func(error){}}
+	if err := batch.enforce(peer); err != nil {
+		return err
+	}
+	if len(batch.sync()) < len(batch.changed) {
+		return fmt.Errorf("could not apply the state of %s to interface %s, it is retried with the next update", peer.Name, peer.Interface)
 	}
+	return nil
+}
 
-	// each line contains a peer's info, excluding the first line whichis the interface info
-	peerLines := strings.Split(strings.TrimSpace(string(bytes)), "\n")[1:]
+func updatePeers() {
+	// get peers info from wg
+	var peerLines []string
+	for _, iface := range config.Interfaces {
+		lines, err := iface.Dump()
+		if err != nil {
+			slog.Error("could not read interface", "interface", iface.Name, "error", err)
+			continue
+		}
+		peerLines = append(peerLines, lines...)
+	}
 
-	var operations []mongo.WriteModel
 	var publicKey string
 	var newTotalTx uint64
 	var newTotalRx uint64
@@ -272,6 +526,7 @@ func updatePeers() {
 		publicKey = info[0]
 
 		if config.Peers[publicKey] == nil {
+			countRetiredKeyUsage(publicKey, info)
 			continue
 		}
 
@@ -287,31 +542,32 @@ func updatePeers() {
 		config.Peers[publicKey].TotalTx = newTotalTx
 
 		// update peer's total usage
+		crossedQuotaThreshold := config.Peers[publicKey].TotalUsage+config.UsageNoticeBytes <= config.Peers[publicKey].AllowedUsage &&
+			config.Peers[publicKey].TotalUsage+config.Peers[publicKey].CurrentRx+config.UsageNoticeBytes > config.Peers[publicKey].AllowedUsage
 		config.Peers[publicKey].TotalUsage += config.Peers[publicKey].CurrentRx
-		operation := mongo.NewUpdateOneModel()
-		operation.SetFilter(bson.M{"publicKey": publicKey})
-		operation.SetUpdate(bson.M{"$set": bson.M{"totalUsage": config.Peers[publicKey].TotalUsage}})
-		operations = append(operations, operation)
+		if config.Peers[publicKey].CurrentRx > 0 {
+			// increment instead of setting the total so resets made by other processes aren't overwritten
+			queueUsage(config.Peers[publicKey], config.Peers[publicKey].CurrentRx)
+		}
+		if crossedQuotaThreshold {
+			emitWebhook(webhookPeerQuotaThreshold, config.Peers[publicKey], map[string]interface{}{"remaining": config.Peers[publicKey].AllowedUsage - config.Peers[publicKey].TotalUsage})
+		}
 
 		// send three days notice
-		if config.Peers[publicKey].TelegramChatID > 0 && !config.Peers[publicKey].ReceivedThreeDaysNotification && config.Peers[publicKey].ExpiresAt-uint64(time.Now().Unix()) < 259200 {
-			msg := tgbotapi.NewMessage(config.Peers[publicKey].TelegramChatID, fmt.Sprintf(`اشتراک شما "%s" کمتر از 3 روز دیگر به پایان میرسد`, config.Peers[publicKey].Name))
-			config.TelegramBot.Send(msg)
-			operation := mongo.NewUpdateOneModel()
-			operation.SetFilter(bson.M{"publicKey": publicKey})
-			operation.SetUpdate(bson.M{"$set": bson.M{"receivedThreeDaysNotification": true}})
-			operations = append(operations, operation)
+		if (len(config.Peers[publicKey].TelegramChatIDs) > 0 || config.Peers[publicKey].Email != "") && !config.Peers[publicKey].ReceivedThreeDaysNotification && config.Peers[publicKey].ExpiresAt-uint64(time.Now().Unix()) < config.ExpiryNoticeDays*86400 {
+			text := fmt.Sprintf(`اشتراک شما "%s" کمتر از %d روز دیگر به پایان میرسد`, config.Peers[publicKey].Name, config.ExpiryNoticeDays)
+			notifyTelegramChats(config.Peers[publicKey], text)
+			notifyEmail(config.Peers[publicKey], text, text)
+			queueFields(config.Peers[publicKey], bson.M{"receivedThreeDaysNotification": true})
 			config.Peers[publicKey].ReceivedThreeDaysNotification = true
 		}
 
 		// send three gigs notice
-		if config.Peers[publicKey].TelegramChatID > 0 && !config.Peers[publicKey].ReceivedThreeGigsNotification && config.Peers[publicKey].AllowedUsage-config.Peers[publicKey].TotalUsage < 3072000000 {
-			msg := tgbotapi.NewMessage(config.Peers[publicKey].TelegramChatID, fmt.Sprintf(`کمتر از 3 گیگابایت از اشتراک شما "%s" باقی مانده است`, config.Peers[publicKey].Name))
-			config.TelegramBot.Send(msg)
-			operation := mongo.NewUpdateOneModel()
-			operation.SetFilter(bson.M{"publicKey": publicKey})
-			operation.SetUpdate(bson.M{"$set": bson.M{"receivedThreeGigsNotification": true}})
-			operations = append(operations, operation)
+		if (len(config.Peers[publicKey].TelegramChatIDs) > 0 || config.Peers[publicKey].Email != "") && !config.Peers[publicKey].ReceivedThreeGigsNotification && config.Peers[publicKey].AllowedUsage-config.Peers[publicKey].TotalUsage < config.UsageNoticeBytes {
+			text := fmt.Sprintf(`کمتر از %s گیگابایت از اشتراک شما "%s" باقی مانده است`, strconv.FormatFloat(float64(config.UsageNoticeBytes)/gigabyte, 'f', -1, 64), config.Peers[publicKey].Name)
+			notifyTelegramChats(config.Peers[publicKey], text)
+			notifyEmail(config.Peers[publicKey], text, text)
+			queueFields(config.Peers[publicKey], bson.M{"receivedThreeGigsNotification": true})
 			config.Peers[publicKey].ReceivedThreeGigsNotification = true
 		}
 
@@ -320,110 +576,127 @@ func updatePeers() {
 
 		// suspend expired peers
 		if (config.Peers[publicKey].ExpiresAt < uint64(time.Now().Unix()) ||
-			config.Peers[publicKey].TotalUsage > config.Peers[publicKey].AllowedUsage) && !config.Peers[publicKey].Suspended {
-			fmt.Println("suspending " + config.Peers[publicKey].Name)
-			// create invalid preshared key
-			invalid := config.Peers[publicKey].ID.Hex() + "AAAAAAAAAAAAAAAAAAA="
-
-			// replace peer's preshared key with the invalid one
-			cmd := exec.Command("sh", config.Path+"/scripts/replace-string.sh", fmt.Sprintf("/etc/wireguard/%s.conf", config.InterfaceName), config.Peers[publicKey].PresharedKey, invalid)
-			_, err := cmd.Output()
+			config.Peers[publicKey].TotalUsage > config.Peers[publicKey].AllowedUsage ||
+			config.Peers[publicKey].Disabled) && !config.Peers[publicKey].Suspended {
+			slog.Info("suspending peer", peerLog(config.Peers[publicKey]),
+				"expired", config.Peers[publicKey].ExpiresAt < uint64(time.Now().Unix()),
+				"overQuota", config.Peers[publicKey].TotalUsage > config.Peers[publicKey].AllowedUsage,
+				"disabled", config.Peers[publicKey].Disabled,
+				"reason", config.Peers[publicKey].DisabledReason)
+			iface, err := suspendPeerConfig(config.Peers[publicKey])
 			if err != nil {
-				fmt.Println(err)
+				slog.Error("could not suspend peer", peerLog(config.Peers[publicKey]), "error", err)
 				continue
 			}
 
-			// get striped config
-			cmd = exec.Command("wg-quick", "strip", config.InterfaceName)
-			configBytes, err := cmd.Output()
+			// apply changes to the interface
+			err = iface.Sync()
 			if err != nil {
-				fmt.Println(err)
-			}
-
-			// write striped config to a file
-			err = os.WriteFile(config.Path+"/"+config.InterfaceName+".conf", configBytes, 0644)
-			if err != nil {
-				fmt.Println(err)
+				slog.Error("could not suspend peer", peerLog(config.Peers[publicKey]), "interface", iface.Name, "error", err)
+				continue
 			}
+			setPeerSuspended(config.Peers[publicKey], true)
+		}
 
-			// save chagnes to main config file
-			cmd = exec.Command("wg", "syncconf", config.InterfaceName, fmt.Sprintf("%s/%s.conf", config.Path, config.InterfaceName))
-			_, err = cmd.Output()
+		// revive suspended peers
+		if config.Peers[publicKey].Suspended && !config.Peers[publicKey].Disabled && (config.Peers[publicKey].ExpiresAt > uint64(time.Now().Unix()) &&
+			config.Peers[publicKey].TotalUsage < config.Peers[publicKey].AllowedUsage) {
+			slog.Info("reviving peer", peerLog(config.Peers[publicKey]))
+			iface, err := revivePeerConfig(config.Peers[publicKey])
 			if err != nil {
-				fmt.Println(err)
+				slog.Error("could not revive peer", peerLog(config.Peers[publicKey]), "error", err)
 				continue
 			}
 
-			// update database
-			config.Peers[publicKey].Suspended = true
-			_, err = config.Collection.UpdateOne(context.TODO(), bson.M{"publicKey": config.Peers[publicKey].PublicKey}, bson.M{"$set": bson.M{"suspended": true}})
+			// apply changes to the interface
+			err = iface.Sync()
 			if err != nil {
-				fmt.Println(err)
+				slog.Error("could not revive peer", peerLog(config.Peers[publicKey]), "interface", iface.Name, "error", err)
 				continue
 			}
+			setPeerSuspended(config.Peers[publicKey], false)
 		}
+	}
 
-		// revive suspended peers
-		if config.Peers[publicKey].Suspended && (config.Peers[publicKey].ExpiresAt > uint64(time.Now().Unix()) &&
-			config.Peers[publicKey].TotalUsage < config.Peers[publicKey].AllowedUsage) {
-			fmt.Println("reviving " + config.Peers[publicKey].Name)
-
-			// create invalid preshared key
-			invalid := config.Peers[publicKey].ID.Hex() + "AAAAAAAAAAAAAAAAAAA="
+	dropRetiredKeys()
 
-			// get peer's info from database
-			p := Peer{}
-			res := config.Collection.FindOne(context.Background(), bson.M{"publicKey": config.Peers[publicKey].PublicKey})
-			err = res.Decode(&p)
-			if err != nil {
-				panic(err)
-			}
+	// failed writes stay queued and are retried, enforcement goes on from memory meanwhile
+	if err := flushQueuedWrites(false); err != nil {
+		slog.Warn("could not write usage, will retry", "pendingWrites", storeStatus().PendingWrites, "error", err)
+	}
+}
 
-			// replace invalid preshared key with the correct one from database
-			cmd := exec.Command("sh", config.Path+"/scripts/replace-string.sh", fmt.Sprintf("/etc/wireguard/%s.conf", config.InterfaceName), invalid, p.PresharedKey)
-			_, err := cmd.Output()
-			if err != nil {
-				panic(err)
-			}
+// invalidPresharedKey replaces the peer's preshared key in its interface's config file while it is suspended
+func invalidPresharedKey(peer *Peer) string {
+	return peer.ID.Hex() + "AAAAAAAAAAAAAAAAAAA="
+}
 
-			// get striped config
-			cmd = exec.Command("wg-quick", "strip", config.InterfaceName)
-			configBytes, err := cmd.Output()
-			if err != nil {
-				fmt.Println(err)
-			}
+// suspendPeerConfig replaces the peer's preshared key in its interface's config file with an invalid one,
+// the device cuts the peer off once the interface is synced
+func suspendPeerConfig(peer *Peer) (*Interface, error) {
+	iface := peerInterface(peer)
+	cmd := exec.Command("sh", config.Path+"/scripts/replace-string.sh", iface.ConfigPath(), peer.PresharedKey, invalidPresharedKey(peer))
+	_, err := cmd.Output()
+	return iface, err
+}
 
-			// write striped config to a file
-			err = os.WriteFile(config.Path+"/"+config.InterfaceName+".conf", configBytes, 0644)
-			if err != nil {
-				fmt.Println(err)
-			}
+// revivePeerConfig puts the peer's preshared key back into its interface's config file, the peer in memory always keeps it
+func revivePeerConfig(peer *Peer) (*Interface, error) {
+	iface := peerInterface(peer)
+	cmd := exec.Command("sh", config.Path+"/scripts/replace-string.sh", iface.ConfigPath(), invalidPresharedKey(peer), peer.PresharedKey)
+	_, err := cmd.Output()
+	return iface, err
+}
 
-			// save chagnes to main config file
-			cmd = exec.Command("wg", "syncconf", config.InterfaceName, fmt.Sprintf("%s/%s.conf", config.Path, config.InterfaceName))
-			_, err = cmd.Output()
-			if err != nil {
-				panic(err)
-			}
+// peerCutOff reports whether the peer has to be suspended because it expired, ran over its allowed usage or is disabled
+func peerCutOff(peer *Peer) bool {
+	return peer.ExpiresAt < uint64(time.Now().Unix()) || peer.TotalUsage > peer.AllowedUsage || peer.Disabled
+}
 
-			// update database
-			config.Peers[publicKey].Suspended = false
-			_, err = config.Collection.UpdateOne(context.TODO(), bson.M{"publicKey": config.Peers[publicKey].PublicKey}, bson.M{"$set": bson.M{"suspended": false}})
-			if err != nil {
-				panic(err)
-			}
-		}
+// setPeerSuspended records that the peer was cut off or revived on the device
+func setPeerSuspended(peer *Peer, suspended bool) {
+	peer.Suspended = suspended
+	queueFields(peer, bson.M{"suspended": suspended})
+	if suspended {
+		emitWebhook(webhookPeerSuspended, peer, nil)
+	} else {
+		emitWebhook(webhookPeerRevived, peer, nil)
 	}
+}
 
-	_, err = config.Collection.BulkWrite(context.TODO(), operations, &options.BulkWriteOptions{})
-	if err != nil {
-		fmt.Println(err)
+// lockPeers holds updateMutex while the request's handler runs, for handlers that change peers
+func lockPeers(c *gin.Context) {
+	updateMutex.Lock()
+	defer updateMutex.Unlock()
+	c.Next()
+}
+
+// readPeers holds the read lock of updateMutex while the request's handler runs, for handlers that only read peers
+func readPeers(c *gin.Context) {
+	updateMutex.RLock()
+	defer updateMutex.RUnlock()
+	c.Next()
+}
+
+// requestClient returns the name and role of the peer the request comes from, or empty strings if it isn't from a peer.
+// It is for handlers that don't hold updateMutex while they run.
+func requestClient(c *gin.Context) (name string, role string) {
+	updateMutex.RLock()
+	defer updateMutex.RUnlock()
+	if client := findPeerByIp(strings.Split(c.Request.RemoteAddr, ":")[0]); client != nil {
+		return client.Name, client.Role
 	}
+	return "", ""
 }
 
 func findPeerByIp(ip string) *Peer {
 	for _, p := range config.Peers {
-		for _, cidr := range strings.Split(p.Address, ",") {
+		addresses := p.Address
+		// clients still using the old keys of a rotated peer connect from its old address
+		if p.RetiredKey != nil {
+			addresses += "," + p.RetiredKey.Address
+		}
+		for _, cidr := range strings.Split(addresses, ",") {
 			if strings.Split(cidr, "/")[0] == ip {
 				return p
 			}
@@ -432,81 +705,114 @@ func findPeerByIp(ip string) *Peer {
 	return nil
 }
 
-func findPeerByName(name string) *Peer {
+// peerForClient returns the peer as client may see it. The telegram token is only shown to the peer itself and those
+// who manage it, anyone holding it can link a chat to the peer.
+func peerForClient(client *Peer, p *Peer) *Peer {
+	if canView(client, p.Name) {
+		return p
+	}
+	hidden := *p
+	hidden.TelegramToken = ""
+	return &hidden
+}
+
+func findPeersByTelegramChatID(chatID int64) []*Peer {
+	var peers []*Peer
 	for _, p := range config.Peers {
-		if p.Name == name {
-			return p
+		if slices.Contains(p.TelegramChatIDs, chatID) {
+			peers = append(peers, p)
 		}
 	}
-	return nil
+	return peers
 }
 
-func generateConfig(peer *Peer) string {
-	return fmt.Sprintf("[Interface]\nPrivateKey = %s\nAddress = %s/%s\nDNS = %s\n[Peer]\nPublicKey = %s\nPresharedKey = %s\nAllowedIPs = 0.0.0.0/0\nEndpoint = %s\n", peer.PrivateKey, peer.Address, strings.Split(config.ServerNetworkAddress, "/")[1], config.DNSServers, config.ServerPublicKey, peer.PresharedKey, config.ServerEndpoint)
+// groupOf returns the group prefix of a peer name, e.g. "shop" for "shop-12"
+func groupOf(name string) string {
+	return strings.Split(name, "-")[0]
 }
 
-func init() {
-	configPath := "config.json"
-	if len(os.Args) > 1 {
-		configPath = os.Args[1] + configPath
-	}
-	bytes, err := os.ReadFile(configPath)
-	if err != nil {
-		panic(err)
-	}
-	err = json.Unmarshal(bytes, &config)
-	if err != nil {
-		panic(err)
-	}
+// canView reports whether client is allowed to see the config of the peer with the given name
+func canView(client *Peer, name string) bool {
+	return client != nil && (client.Name == name || canManage(client, name))
+}
+
+// canManage reports whether client is allowed to modify the peer with the given name
+func canManage(client *Peer, name string) bool {
+	return !(client == nil || client.Role == "user" || (client.Role == "distributor" && groupOf(client.Name) != groupOf(name)))
+}
 
-	config.Peers = make(map[string]*Peer)
+func findPeerByName(name string) *Peer {
+	for _, p := range config.Peers {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
 
+func connectDatabase() error {
 	client, err := mongo.Connect(
 		context.TODO(),
-		options.Client().ApplyURI(config.MongoURI).SetServerAPIOptions(options.ServerAPI(options.ServerAPIVersion1)))
+		options.Client().ApplyURI(config.MongoURI).SetServerAPIOptions(options.ServerAPI(options.ServerAPIVersion1)).SetServerSelectionTimeout(storeTimeout))
 	if err != nil {
-		panic(err)
+		return err
 	}
 	config.Collection = client.Database(config.DBName).Collection(config.CollectionName)
+	config.WebhookDeliveries = client.Database(config.DBName).Collection(config.WebhookDeliveriesCollectionName)
+	return nil
+}
+
+// loadPeers loads peers from the database with their current transfer counters
+func loadPeers() error {
 	var data []Peer
 	cursor, err := config.Collection.Find(context.TODO(), bson.D{})
 	if err != nil {
-		panic(err)
+		return err
 	}
 	if err = cursor.All(context.TODO(), &data); err != nil {
-		panic(err)
+		return err
 	}
-	if len(data) == 0 {
-		err := os.MkdirAll("/root/configs", 0700)
-		if err != nil {
-			panic(err)
-		}
-		p, err := createPeer("Admin-0", "admin")
-		if err != nil {
-			panic(err)
+	for i, p := range data {
+		if p.DeletedAt != 0 {
+			config.Trash[p.PublicKey] = &data[i]
+			continue
 		}
-		config := generateConfig(p)
-		err = os.WriteFile("/root/configs/Admin-0.conf", []byte(config), 0644)
-		if err != nil {
-			panic(err)
+		config.Peers[p.PublicKey] = &data[i]
+
+		// move chat ids linked before peers could have several chats into the list
+		if p.LegacyTelegramChatID != 0 {
+			if !slices.Contains(p.TelegramChatIDs, p.LegacyTelegramChatID) {
+				data[i].TelegramChatIDs = append(data[i].TelegramChatIDs, p.LegacyTelegramChatID)
+			}
+			data[i].LegacyTelegramChatID = 0
+			_, err = config.Collection.UpdateOne(
+				context.TODO(),
+				bson.M{"publicKey": p.PublicKey},
+				bson.M{"$set": bson.M{"telegramChatIDs": data[i].TelegramChatIDs}, "$unset": bson.M{"telegramChatID": ""}})
+			if err != nil {
+				return err
+			}
 		}
-		fmt.Println("Created new peer in /root/configs/Admin-0.conf\nUse it to connect Wireguard UI admin panel.")
 	}
 
-	for i, p := range data {
-		config.Peers[p.PublicKey] = &data[i]
-	}
+	loadTransferCounters(nil)
+	return nil
+}
 
+// loadTransferCounters sets the transfer counters of the peers with the given public keys, or of all peers when nil,
+// to the device's so transfer from before isn't counted as usage
+func loadTransferCounters(publicKeys map[string]bool) {
 	// get peers info from wg
-	cmd := exec.Command("wg", "show", config.InterfaceName, "dump")
-	bytes, err = cmd.Output()
-	if err != nil {
-		panic(err)
+	var peerLines []string
+	for _, iface := range config.Interfaces {
+		lines, err := iface.Dump()
+		if err != nil {
+			slog.Warn("could not read interface, is it up?", "interface", iface.Name, "error", err)
+			continue
+		}
+		peerLines = append(peerLines, lines...)
 	}
 
-	// each line contains a peer's info, excluding the first line whichis the interface info
-	peerLines := strings.Split(strings.TrimSpace(string(bytes)), "\n")[1:]
-
 	var publicKey string
 	var newTotalTx uint64
 	var newTotalRx uint64
@@ -516,7 +822,7 @@ func init() {
 		// find public key
 		publicKey = info[0]
 
-		if config.Peers[publicKey] == nil {
+		if config.Peers[publicKey] == nil || publicKeys != nil && !publicKeys[publicKey] {
 			continue
 		}
 
@@ -528,92 +834,189 @@ func init() {
 	}
 }
 
-func main() {
-	// get peers info every second
-	go func() {
-		for range time.NewTicker(time.Second).C {
-			updatePeers()
-		}
-	}()
+// syncPeersFromStore applies peers created, changed or deleted in the database by other processes, while keeping the
+// transfer counters this process tracks
+func syncPeersFromStore() error {
+	var data []Peer
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	cursor, err := config.Collection.Find(ctx, bson.D{})
+	if err == nil {
+		err = cursor.All(ctx, &data)
+	}
+	recordStoreResult(err)
+	if err != nil {
+		return err
+	}
 
-	// check for telegram bot updates
-	go func() {
-		var err error
-		config.TelegramBot, err = tgbotapi.NewBotAPI(config.TelegramBotToken)
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
-		fmt.Printf("telegram bot username: %s\n", config.TelegramBot.Self.UserName)
-		u := tgbotapi.NewUpdate(0)
-		u.Timeout = 60
-		updates := config.TelegramBot.GetUpdatesChan(u)
-		for update := range updates {
-			if update.Message != nil {
-				// check if message is command
-				if update.Message.Command() != "" {
-					if update.Message.Command() == "start" { // check if its add register command
-						tt := update.Message.CommandArguments()
-						// check if arg is peer's telegram token
-						if len(tt) == 36 {
-							p := Peer{}
-							res := config.Collection.FindOne(context.Background(), bson.M{"telegramToken": tt})
-							err = res.Decode(&p)
-							if err != nil {
-								fmt.Println(err)
-								msg := tgbotapi.NewMessage(update.Message.Chat.ID, "درخواست نامعتبر")
-								msg.ReplyToMessageID = update.Message.MessageID
-								config.TelegramBot.Send(msg)
-								continue
-							}
-							_, err = config.Collection.UpdateOne(
-								context.TODO(),
-								bson.M{"telegramToken": tt},
-								bson.M{"$set": bson.M{"telegramChatID": update.Message.From.ID}})
-							if err != nil {
-								fmt.Println(err)
-								msg := tgbotapi.NewMessage(update.Message.Chat.ID, "درخواست نامعتبر")
-								msg.ReplyToMessageID = update.Message.MessageID
-								config.TelegramBot.Send(msg)
-								continue
-							}
-							msg := tgbotapi.NewMessage(update.Message.Chat.ID, fmt.Sprintf(`اشتراک شما "%s" ثبت شد`, p.Name))
-							msg.ReplyToMessageID = update.Message.MessageID
-							config.TelegramBot.Send(msg)
-						}
-					}
-				}
-			}
+	stored := make(map[string]bool)
+	added := make(map[string]bool)
+	trash := make(map[string]*Peer)
+	for i, p := range data {
+		if p.DeletedAt != 0 {
+			trash[p.PublicKey] = &data[i]
+			continue
 		}
-	}()
-
-	gin.SetMode(gin.ReleaseMode)
-	gin.DefaultWriter = io.Discard
-	r := gin.Default()
-	r.Use(static.Serve("/", static.LocalFile(config.Path+"/public/build", false)))
-	r.Use(func(c *gin.Context) {
-		c.Header("Access-Control-Allow-Origin", "*")
-		c.Next()
-	})
-	r.GET("/ws", func(c *gin.Context) {
-		ra := c.Request.RemoteAddr
-		peer := findPeerByIp(strings.Split(ra, ":")[0])
-		if peer == nil {
-			c.AbortWithStatus(403)
-			return
+		stored[p.PublicKey] = true
+		existing := config.Peers[p.PublicKey]
+		if existing == nil {
+			config.Peers[p.PublicKey] = &data[i]
+			added[p.PublicKey] = true
+			continue
 		}
-		upgrader := websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
-		conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
-		if err != nil {
-			http.Error(c.Writer, "could not open websocket connection", http.StatusBadRequest)
-			fmt.Println(err)
-			return
+		data[i].LatestHandshake = existing.LatestHandshake
+		data[i].TotalRx = existing.TotalRx
+		data[i].TotalTx = existing.TotalTx
+		data[i].CurrentRx = existing.CurrentRx
+		data[i].CurrentTx = existing.CurrentTx
+		if existing.RetiredKey != nil && data[i].RetiredKey != nil && existing.RetiredKey.PublicKey == data[i].RetiredKey.PublicKey {
+			data[i].RetiredKey.TotalRx, data[i].RetiredKey.counted = existing.RetiredKey.TotalRx, existing.RetiredKey.counted
 		}
-		tempPeers := make(map[string]*Peer)
-		for {
+		// writes that haven't reached the database yet are newer than what was read
+		usage, fields := queuedWrites(existing)
+		data[i].TotalUsage += usage
+		if fields {
+			data[i].Suspended = existing.Suspended
+			data[i].ReceivedThreeDaysNotification = existing.ReceivedThreeDaysNotification
+			data[i].ReceivedThreeGigsNotification = existing.ReceivedThreeGigsNotification
+		}
+		*existing = data[i]
+	}
+	for publicKey := range config.Peers {
+		if !stored[publicKey] {
+			delete(config.Peers, publicKey)
+		}
+	}
+	config.Trash = trash
+	// new peers may already have transfer on the device, like imported or restored ones
+	if len(added) > 0 {
+		loadTransferCounters(added)
+	}
+	return nil
+}
+
+// initialize loads config.json, connects to the database and loads peers with their current usage
+func initialize(configPath string) error {
+	if err := loadConfig(configPath); err != nil {
+		return err
+	}
+	configFile = configPath
+	// commands that change peers refuse to run while the server holds the lock
+	if err := lockState(); err != nil {
+		return err
+	}
+	if err := connectDatabase(); err != nil {
+		return err
+	}
+	if err := loadPeers(); err != nil {
+		return err
+	}
+	recordStoreResult(nil)
+	if len(config.Peers) == 0 {
+		return createFirstAdmin()
+	}
+	return nil
+}
+
+// createFirstAdmin creates the Admin-0 peer and writes its config to /root/configs
+func createFirstAdmin() error {
+	err := os.MkdirAll("/root/configs", 0700)
+	if err != nil {
+		return err
+	}
+	p, err := createPeer("Admin-0", "admin", "", nil)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile("/root/configs/Admin-0.conf", []byte(generateConfig(p)), 0644)
+	if err != nil {
+		return err
+	}
+	slog.Info("created the first admin peer, use it to connect to the Wireguard UI admin panel", peerLog(p), "config", "/root/configs/Admin-0.conf")
+	return nil
+}
+
+func main() {
+	if err := runCommand(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// serve starts the web server, the telegram bot and the background jobs
+func serve(configPath string) error {
+	if err := initialize(configPath); err != nil {
+		return err
+	}
+
+	// get peers info every second and pick up changes made to the database by other processes every ten seconds
+	go func() {
+		ticks := 0
+		for range time.NewTicker(time.Second).C {
+			updateMutex.Lock()
+			ticks++
+			if ticks%10 == 0 {
+				if err := syncPeersFromStore(); err != nil {
+					slog.Warn("could not sync peers from the database", "error", err)
+				}
+			}
+			updatePeers()
+			lastUpdateAt.Store(time.Now().Unix())
+			updateMutex.Unlock()
+		}
+	}()
+
+	// reload the config on SIGHUP and flush usage before exiting on SIGTERM
+	go handleSignals()
+	go runWatchdog()
+	go runScheduledBackups()
+	go runTrashPurge()
+
+	// check for telegram bot updates
+	go runTelegramBot()
+
+	// serve the node agent api and follow remote nodes
+	if config.AgentAddress != "" && config.AgentToken != "" {
+		go runAgent()
+	}
+	for _, n := range config.Nodes {
+		go n.watch()
+	}
+
+	gin.SetMode(gin.ReleaseMode)
+	gin.DefaultWriter = io.Discard
+	r := gin.New()
+	r.Use(accessLog, gin.CustomRecovery(recoverPanics))
+	registerHealthRoutes(r)
+	r.Use(static.Serve("/", static.LocalFile(config.Path+"/public/build", false)))
+	r.Use(func(c *gin.Context) {
+		c.Header("Access-Control-Allow-Origin", "*")
+		c.Next()
+	})
+	r.GET("/ws", func(c *gin.Context) {
+		ra := c.Request.RemoteAddr
+		updateMutex.RLock()
+		peer := findPeerByIp(strings.Split(ra, ":")[0])
+		updateMutex.RUnlock()
+		if peer == nil {
+			c.AbortWithStatus(403)
+			return
+		}
+		upgrader := websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+		conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			http.Error(c.Writer, "could not open websocket connection", http.StatusBadRequest)
+			c.Error(err)
+			return
+		}
+		tempPeers := make(map[string]*Peer)
+		for {
 			time.Sleep(time.Second)
+			// the peers are encoded under the read lock, a slow client only holds up its own connection
+			updateMutex.RLock()
+			var message []byte
 			if peer.Role == "admin" {
-				conn.WriteJSON(map[string]interface{}{
+				message, err = json.Marshal(map[string]interface{}{
 					"peers": config.Peers,
 					"role":  peer.Role,
 					"name":  peer.Name,
@@ -622,21 +1025,29 @@ func main() {
 				clear(tempPeers)
 				for pk, p := range config.Peers {
 					if strings.HasPrefix(p.Name, strings.Split(peer.Name, "-")[0]+"-") {
-						tempPeers[pk] = p
+						tempPeers[pk] = peerForClient(peer, p)
 					}
 				}
-				conn.WriteJSON(map[string]interface{}{
+				message, err = json.Marshal(map[string]interface{}{
 					"peers": tempPeers,
 					"role":  peer.Role,
 					"name":  peer.Name,
 				})
 			}
+			updateMutex.RUnlock()
+			if err != nil {
+				c.Error(err)
+				return
+			}
+			if err = conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				return
+			}
 		}
 	})
-	r.PATCH("/api/peers/:name", func(c *gin.Context) {
+	r.PATCH("/api/peers/:name", lockPeers, func(c *gin.Context) {
 		ra := c.Request.RemoteAddr
 		client := findPeerByIp(strings.Split(ra, ":")[0])
-		if client == nil || client.Role == "user" || (client.Role == "distributor" && strings.Split(client.Name, "-")[0] != strings.Split(c.Param("name"), "-")[0]) {
+		if !canManage(client, c.Param("name")) {
 			c.AbortWithStatus(403)
 			return
 		}
@@ -649,54 +1060,137 @@ func main() {
 		newPeer := &Peer{}
 		err := c.BindJSON(&newPeer)
 		if err != nil {
-			fmt.Println(err)
+			c.Error(err)
 			c.AbortWithStatus(400)
 			return
 		}
+		if newPeer.ClientSettings != nil {
+			if err = newPeer.ClientSettings.validate(); err != nil {
+				c.JSON(400, map[string]interface{}{"error": err.Error()})
+				return
+			}
+		}
+		if newPeer.Email, err = validateEmail(newPeer.Email); err != nil {
+			c.JSON(400, map[string]interface{}{"error": err.Error()})
+			return
+		}
+		renamed := newPeer.Name != "" && newPeer.Name != peer.Name
+		if renamed {
+			if err = validateRename(client, peer, newPeer.Name); err != nil {
+				c.JSON(400, map[string]interface{}{"error": err.Error()})
+				return
+			}
+		}
+		// the changes go to a copy that replaces the peer once they are stored
+		updated := *peer
+		changes := bson.M{}
+		oldName := peer.Name
+		extended := newPeer.ExpiresAt > peer.ExpiresAt || newPeer.AllowedUsage > peer.AllowedUsage
 		if newPeer.ExpiresAt != 0 {
-			if newPeer.ExpiresAt > peer.ExpiresAt && newPeer.ExpiresAt-uint64(time.Now().Unix()) > 259200 {
-				peer.ReceivedThreeDaysNotification = false
+			if newPeer.ExpiresAt > peer.ExpiresAt && newPeer.ExpiresAt-uint64(time.Now().Unix()) > config.ExpiryNoticeDays*86400 {
+				updated.ReceivedThreeDaysNotification = false
 				update["receivedThreeDaysNotification"] = false
 			}
-			peer.ExpiresAt = newPeer.ExpiresAt
-			update["expiresAt"] = peer.ExpiresAt
+			updated.ExpiresAt = newPeer.ExpiresAt
+			update["expiresAt"] = updated.ExpiresAt
 		}
-		if newPeer.Name != "" {
-			peer.Name = newPeer.Name
-			update["name"] = peer.Name
+		if renamed {
+			changes["$push"] = bson.M{"nameHistory": renameChange(&updated, newPeer.Name, client.Name)}
+			update["name"] = updated.Name
 		}
 		if newPeer.AllowedUsage != 0 {
-			if newPeer.AllowedUsage > peer.AllowedUsage && newPeer.AllowedUsage-peer.TotalUsage > 3072000000 {
-				peer.ReceivedThreeGigsNotification = false
+			if newPeer.AllowedUsage > peer.AllowedUsage && newPeer.AllowedUsage-peer.TotalUsage > config.UsageNoticeBytes {
+				updated.ReceivedThreeGigsNotification = false
 				update["receivedThreeGigsNotification"] = false
 			}
-			peer.AllowedUsage = newPeer.AllowedUsage
-			update["allowedUsage"] = peer.AllowedUsage
+			updated.AllowedUsage = newPeer.AllowedUsage
+			update["allowedUsage"] = updated.AllowedUsage
 		}
 		if newPeer.Role != "" {
-			peer.Role = newPeer.Role
-			update["role"] = peer.Role
+			updated.Role = newPeer.Role
+			update["role"] = updated.Role
+		}
+		if newPeer.ClientSettings != nil {
+			updated.ClientSettings = newPeer.ClientSettings
+			update["clientSettings"] = updated.ClientSettings
 		}
-		_, err = config.Collection.UpdateOne(context.TODO(), bson.M{"publicKey": peer.PublicKey}, bson.M{"$set": update})
+		if newPeer.Email != "" {
+			updated.Email = newPeer.Email
+			update["email"] = updated.Email
+		}
+		if newPeer.Tags != nil {
+			updated.Tags = normalizeTags(newPeer.Tags)
+			update["tags"] = updated.Tags
+		}
+		changes["$set"] = update
+		_, err = config.Collection.UpdateOne(context.TODO(), bson.M{"publicKey": peer.PublicKey}, changes)
 		if err != nil {
-			fmt.Println(err)
+			c.Error(err)
 			c.AbortWithStatus(400)
 			return
 		}
+		*peer = updated
+		if renamed {
+			requestLogger(c).Info("renamed peer", peerLog(peer), "oldName", oldName)
+			emitWebhook(webhookPeerRenamed, peer, map[string]interface{}{"oldName": oldName})
+		}
+		if extended {
+			emitWebhook(webhookPeerExtended, peer, nil)
+		}
 		c.AbortWithStatus(200)
 	})
-	r.GET("/api/peers/:name", func(c *gin.Context) {
+	r.POST("/api/bulk", lockPeers, func(c *gin.Context) {
+		ra := c.Request.RemoteAddr
+		client := findPeerByIp(strings.Split(ra, ":")[0])
+		if client == nil || client.Role == "user" {
+			c.AbortWithStatus(403)
+			return
+		}
+		req := &BulkRequest{}
+		if err := c.BindJSON(req); err != nil {
+			c.Error(err)
+			return
+		}
+		result, err := runBulk(client, req)
+		if err != nil {
+			c.JSON(400, map[string]interface{}{"error": err.Error()})
+			return
+		}
+		c.JSON(200, result)
+	})
+	r.GET("/api/peers", readPeers, func(c *gin.Context) {
+		ra := c.Request.RemoteAddr
+		client := findPeerByIp(strings.Split(ra, ":")[0])
+		if client == nil {
+			c.AbortWithStatus(403)
+			return
+		}
+		q := &PeerListQuery{}
+		if err := c.ShouldBindQuery(q); err != nil {
+			c.JSON(400, map[string]interface{}{"error": err.Error()})
+			return
+		}
+		list, err := listPeers(client, q)
+		if err != nil {
+			c.JSON(400, map[string]interface{}{"error": err.Error()})
+			return
+		}
+		c.JSON(200, list)
+	})
+	r.GET("/api/peers/:name", readPeers, func(c *gin.Context) {
+		ra := c.Request.RemoteAddr
+		client := findPeerByIp(strings.Split(ra, ":")[0])
 		name := c.Param("name")
-		if p := findPeerByName(name); p != nil {
-			c.JSON(200, p)
+		if p := findPeerByAnyName(name); p != nil {
+			c.JSON(200, peerForClient(client, p))
 		} else {
 			c.AbortWithStatus(400)
 		}
 	})
-	r.POST("/api/peers/:name", func(c *gin.Context) {
+	r.POST("/api/peers/:name", lockPeers, func(c *gin.Context) {
 		ra := c.Request.RemoteAddr
 		client := findPeerByIp(strings.Split(ra, ":")[0])
-		if client == nil || client.Role == "user" || (client.Role == "distributor" && strings.Split(client.Name, "-")[0] != strings.Split(c.Param("name"), "-")[0]) {
+		if !canManage(client, c.Param("name")) {
 			c.AbortWithStatus(403)
 			return
 		}
@@ -704,41 +1198,62 @@ func main() {
 		p := &Peer{}
 		err := c.BindJSON(&p)
 		if err != nil {
-			fmt.Println(err)
+			c.Error(err)
 			c.AbortWithStatus(400)
 			return
 		}
-		p, err = createPeer(name, p.Role)
+		email, err := validateEmail(p.Email)
 		if err != nil {
-			fmt.Println(err)
 			c.JSON(400, map[string]interface{}{"error": err.Error()})
-		} else {
-			c.JSON(201, p)
+			return
+		}
+		p, err = createPeer(name, p.Role, p.Interface, nil)
+		if err != nil {
+			c.Error(err)
+			c.JSON(400, map[string]interface{}{"error": err.Error()})
+			return
 		}
+		if email != "" {
+			if err = setPeerEmail(p, email); err != nil {
+				c.Error(err)
+			} else if config.SMTP != nil && config.SMTP.SendConfigOnCreate {
+				// sendPeerConfigEmail waits for the handler to release updateMutex
+				go func(p *Peer, log slog.Attr) {
+					if err := sendPeerConfigEmail(p); err != nil {
+						slog.Error("could not email config", log, "error", err)
+					}
+				}(p, peerLog(p))
+			}
+		}
+		c.JSON(201, p)
 	})
-	r.DELETE("/api/peers/:name", func(c *gin.Context) {
+	r.DELETE("/api/peers/:name", lockPeers, func(c *gin.Context) {
 		ra := c.Request.RemoteAddr
 		client := findPeerByIp(strings.Split(ra, ":")[0])
-		if client == nil || client.Role == "user" || (client.Role == "distributor" && strings.Split(client.Name, "-")[0] != strings.Split(c.Param("name"), "-")[0]) {
+		// peers go to the trash, only admins can delete them for good
+		purge := c.Query("purge") == "true"
+		if !canManage(client, c.Param("name")) || purge && client.Role != "admin" {
 			c.AbortWithStatus(403)
 			return
 		}
-		err := deletePeer(c.Param("name"))
+		err := deletePeer(c.Param("name"), client.Name, purge)
 		if err != nil {
 			if err.Error() == "peer not found" {
 				c.AbortWithStatus(400)
+			} else if err == errTrashNameTaken {
+				c.JSON(409, map[string]interface{}{"error": err.Error()})
 			} else {
-				fmt.Println(err)
+				c.Error(err)
 				c.AbortWithStatus(500)
 			}
 			return
 		}
 		c.AbortWithStatus(200)
 	})
-	r.GET("/api/reset-usage/:name", func(c *gin.Context) {
+	r.POST("/api/peers/:name/rotate-keys", lockPeers, func(c *gin.Context) {
 		ra := c.Request.RemoteAddr
 		client := findPeerByIp(strings.Split(ra, ":")[0])
-		if client == nil || client.Role == "user" || (client.Role == "distributor" && strings.Split(client.Name, "-")[0] != strings.Split(c.Param("name"), "-")[0]) {
+		if !canManage(client, c.Param("name")) {
 			c.AbortWithStatus(403)
 			return
 		}
@@ -747,31 +1262,497 @@ func main() {
 			c.AbortWithStatus(400)
 			return
 		}
-		peer.TotalUsage = 0
-		peer.ReceivedThreeGigsNotification = false
-		_, err := config.Collection.UpdateOne(
-			context.TODO(),
-			bson.M{"publicKey": peer.PublicKey},
-			bson.M{"$set": bson.M{"totalUsage": 0, "receivedThreeGigsNotification": false}})
+		req := &RotateRequest{}
+		// without a body both the keypair and the preshared key are replaced
+		if c.Request.ContentLength != 0 {
+			if err := c.BindJSON(req); err != nil {
+				c.Error(err)
+				return
+			}
+		}
+		if err := rotatePeerKeys(peer, req); err != nil {
+			c.Error(err)
+			c.JSON(400, map[string]interface{}{"error": err.Error()})
+			return
+		}
+		res := RotateResponse{Peer: peer}
+		if peer.RetiredKey != nil {
+			res.PreviousAddress = peer.RetiredKey.Address
+		}
+		c.JSON(200, res)
+	})
+	r.GET("/api/trash", readPeers, func(c *gin.Context) {
+		ra := c.Request.RemoteAddr
+		client := findPeerByIp(strings.Split(ra, ":")[0])
+		if client == nil || client.Role == "user" {
+			c.AbortWithStatus(403)
+			return
+		}
+		c.JSON(200, trashedPeers(client))
+	})
+	r.POST("/api/trash/:name/restore", lockPeers, func(c *gin.Context) {
+		ra := c.Request.RemoteAddr
+		client := findPeerByIp(strings.Split(ra, ":")[0])
+		if !canManage(client, c.Param("name")) {
+			c.AbortWithStatus(403)
+			return
+		}
+		peer, err := restorePeer(c.Param("name"))
+		if err != nil {
+			c.Error(err)
+			c.JSON(400, map[string]interface{}{"error": err.Error()})
+			return
+		}
+		c.JSON(200, peer)
+	})
+	r.DELETE("/api/trash/:name", lockPeers, func(c *gin.Context) {
+		ra := c.Request.RemoteAddr
+		client := findPeerByIp(strings.Split(ra, ":")[0])
+		if client == nil || client.Role != "admin" {
+			c.AbortWithStatus(403)
+			return
+		}
+		peer := findTrashedPeer(c.Param("name"))
+		if peer == nil {
+			c.AbortWithStatus(400)
+			return
+		}
+		if err := purgePeer(peer); err != nil {
+			c.Error(err)
+			c.AbortWithStatus(500)
+			return
+		}
+		c.AbortWithStatus(200)
+	})
+	r.GET("/api/reset-usage/:name", lockPeers, func(c *gin.Context) {
+		ra := c.Request.RemoteAddr
+		client := findPeerByIp(strings.Split(ra, ":")[0])
+		if !canManage(client, c.Param("name")) {
+			c.AbortWithStatus(403)
+			return
+		}
+		peer := findPeerByName(c.Param("name"))
+		if peer == nil {
+			c.AbortWithStatus(400)
+			return
+		}
+		err := resetPeerUsage(peer)
+		if err != nil {
+			c.Error(err)
+			c.AbortWithStatus(400)
+			return
+		}
+		c.AbortWithStatus(200)
+	})
+	r.POST("/api/peers/:name/suspend", lockPeers, func(c *gin.Context) {
+		ra := c.Request.RemoteAddr
+		client := findPeerByIp(strings.Split(ra, ":")[0])
+		if !canManage(client, c.Param("name")) {
+			c.AbortWithStatus(403)
+			return
+		}
+		peer := findPeerByName(c.Param("name"))
+		if peer == nil {
+			c.AbortWithStatus(400)
+			return
+		}
+		req := struct {
+			Reason string `json:"reason"`
+		}{}
+		// the reason is optional, an empty body suspends without one
+		if c.Request.ContentLength != 0 {
+			if err := c.BindJSON(&req); err != nil {
+				c.Error(err)
+				return
+			}
+		}
+		if err := setPeerDisabled(peer, true, strings.TrimSpace(req.Reason), client.Name); err != nil {
+			c.Error(err)
+			c.AbortWithStatus(500)
+			return
+		}
+		if err := applyPeerState(peer); err != nil {
+			requestLogger(c).Error("could not suspend peer", peerLog(peer), "error", err)
+		}
+		c.JSON(200, peer)
+	})
+	r.POST("/api/peers/:name/resume", lockPeers, func(c *gin.Context) {
+		ra := c.Request.RemoteAddr
+		client := findPeerByIp(strings.Split(ra, ":")[0])
+		if !canManage(client, c.Param("name")) {
+			c.AbortWithStatus(403)
+			return
+		}
+		peer := findPeerByName(c.Param("name"))
+		if peer == nil {
+			c.AbortWithStatus(400)
+			return
+		}
+		if err := setPeerDisabled(peer, false, "", client.Name); err != nil {
+			c.Error(err)
+			c.AbortWithStatus(500)
+			return
+		}
+		if err := applyPeerState(peer); err != nil {
+			requestLogger(c).Error("could not revive peer", peerLog(peer), "error", err)
+		}
+		c.JSON(200, peer)
+	})
+	r.POST("/api/telegram-token/:name", lockPeers, func(c *gin.Context) {
+		ra := c.Request.RemoteAddr
+		client := findPeerByIp(strings.Split(ra, ":")[0])
+		if !canManage(client, c.Param("name")) {
+			c.AbortWithStatus(403)
+			return
+		}
+		peer := findPeerByName(c.Param("name"))
+		if peer == nil {
+			c.AbortWithStatus(400)
+			return
+		}
+		err := rotateTelegramToken(peer, c.Query("unlink") == "true")
+		if err != nil {
+			c.Error(err)
+			c.AbortWithStatus(500)
+			return
+		}
+		c.JSON(200, map[string]interface{}{"telegramToken": peer.TelegramToken})
+	})
+	r.DELETE("/api/telegram-chats/:name", lockPeers, func(c *gin.Context) {
+		ra := c.Request.RemoteAddr
+		client := findPeerByIp(strings.Split(ra, ":")[0])
+		if !canManage(client, c.Param("name")) {
+			c.AbortWithStatus(403)
+			return
+		}
+		peer := findPeerByName(c.Param("name"))
+		if peer == nil {
+			c.AbortWithStatus(400)
+			return
+		}
+		for _, chatID := range slices.Clone(peer.TelegramChatIDs) {
+			if err := unlinkTelegramChat(peer, chatID); err != nil {
+				c.Error(err)
+				c.AbortWithStatus(500)
+				return
+			}
+		}
+		c.AbortWithStatus(200)
+	})
+	registerFleetRoutes(r)
+	r.GET("/api/interfaces", readPeers, func(c *gin.Context) {
+		ra := c.Request.RemoteAddr
+		client := findPeerByIp(strings.Split(ra, ":")[0])
+		if client == nil || client.Role == "user" {
+			c.AbortWithStatus(403)
+			return
+		}
+		c.JSON(200, config.Interfaces)
+	})
+	r.POST("/api/reload", func(c *gin.Context) {
+		if _, role := requestClient(c); role != "admin" {
+			c.AbortWithStatus(403)
+			return
+		}
+		result, err := reloadConfig()
+		if err != nil {
+			c.JSON(400, map[string]interface{}{"error": err.Error()})
+			return
+		}
+		c.JSON(200, result)
+	})
+	r.GET("/api/store-status", readPeers, func(c *gin.Context) {
+		ra := c.Request.RemoteAddr
+		client := findPeerByIp(strings.Split(ra, ":")[0])
+		if client == nil || client.Role != "admin" {
+			c.AbortWithStatus(403)
+			return
+		}
+		c.JSON(200, storeStatus())
+	})
+	r.POST("/api/backup", readPeers, func(c *gin.Context) {
+		ra := c.Request.RemoteAddr
+		client := findPeerByIp(strings.Split(ra, ":")[0])
+		if client == nil || client.Role != "admin" {
+			c.AbortWithStatus(403)
+			return
+		}
+		// the passphrase defaults to the configured one, an empty body is fine
+		body := struct {
+			Passphrase *string `json:"passphrase"`
+		}{}
+		if err := c.ShouldBindJSON(&body); err != nil && !errors.Is(err, io.EOF) {
+			c.JSON(400, map[string]interface{}{"error": err.Error()})
+			return
+		}
+		passphrase := config.Backup.Passphrase
+		if body.Passphrase != nil {
+			passphrase = *body.Passphrase
+		}
+		var buf bytes.Buffer
+		if _, err := writeBackup(&buf, passphrase); err != nil {
+			c.Error(err)
+			c.AbortWithStatus(500)
+			return
+		}
+		name := backupFilePrefix + time.Now().UTC().Format("20060102-150405") + ".zip"
+		if passphrase != "" {
+			name += ".enc"
+		}
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+		c.Data(200, "application/octet-stream", buf.Bytes())
+	})
+	r.POST("/api/restore", func(c *gin.Context) {
+		// restoreBackup takes updateMutex itself
+		if _, role := requestClient(c); role != "admin" {
+			c.AbortWithStatus(403)
+			return
+		}
+		updateMutex.RLock()
+		passphrase := config.Backup.Passphrase
+		updateMutex.RUnlock()
+		file, err := c.FormFile("backup")
+		if err != nil {
+			c.JSON(400, map[string]interface{}{"error": "backup file is required"})
+			return
+		}
+		f, err := file.Open()
+		if err != nil {
+			c.Error(err)
+			c.AbortWithStatus(500)
+			return
+		}
+		data, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			c.Error(err)
+			c.AbortWithStatus(500)
+			return
+		}
+		if p, ok := c.GetPostForm("passphrase"); ok {
+			passphrase = p
+		}
+		b, err := readBackup(data, passphrase)
+		if err != nil {
+			c.JSON(400, map[string]interface{}{"error": err.Error()})
+			return
+		}
+		// a dry run only validates the backup
+		if c.PostForm("dryRun") == "true" {
+			c.JSON(200, map[string]interface{}{"manifest": b.Manifest})
+			return
+		}
+		result, err := restoreBackup(b, c.PostForm("withConfig") == "true")
+		if err != nil {
+			c.Error(err)
+			c.JSON(500, map[string]interface{}{"error": err.Error()})
+			return
+		}
+		c.JSON(200, result)
+	})
+	r.POST("/api/import", lockPeers, func(c *gin.Context) {
+		ra := c.Request.RemoteAddr
+		client := findPeerByIp(strings.Split(ra, ":")[0])
+		if client == nil || client.Role != "admin" {
+			c.AbortWithStatus(403)
+			return
+		}
+		req := struct {
+			From string `json:"from"`
+			// Files holds the content of the files to import by file name, peers on the interfaces need none
+			Files     map[string]string `json:"files"`
+			Interface string            `json:"interface"`
+			Plan      string            `json:"plan"`
+			Days      uint64            `json:"days"`
+			GB        uint64            `json:"gb"`
+			Role      string            `json:"role"`
+			Prefix    string            `json:"prefix"`
+			DryRun    bool              `json:"dryRun"`
+		}{}
+		if err := c.BindJSON(&req); err != nil {
+			c.Error(err)
+			return
+		}
+		options := ImportOptions{Interface: req.Interface, Days: req.Days, AllowedUsage: req.GB * gigabyte, Role: req.Role, Prefix: req.Prefix, DryRun: req.DryRun}
+		if req.Plan != "" {
+			if options.Plan = findPlan(req.Plan); options.Plan == nil {
+				c.JSON(400, map[string]interface{}{"error": "plan not found"})
+				return
+			}
+		}
+		files := map[string][]byte{}
+		for name, content := range req.Files {
+			files[name] = []byte(content)
+		}
+		candidates, err := importCandidates(req.From, files, req.Interface)
 		if err != nil {
-			fmt.Println(err)
+			c.JSON(400, map[string]interface{}{"error": err.Error()})
+			return
+		}
+		results, err := importPeers(candidates, req.From, options)
+		if err != nil {
+			c.Error(err)
+			c.JSON(500, map[string]interface{}{"error": err.Error()})
+			return
+		}
+		c.JSON(200, results)
+	})
+	r.GET("/api/webhook-deliveries", readPeers, func(c *gin.Context) {
+		ra := c.Request.RemoteAddr
+		client := findPeerByIp(strings.Split(ra, ":")[0])
+		if client == nil || client.Role != "admin" {
+			c.AbortWithStatus(403)
+			return
+		}
+		deliveries, err := latestWebhookDeliveries(100)
+		if err != nil {
+			c.Error(err)
+			c.AbortWithStatus(500)
+			return
+		}
+		c.JSON(200, deliveries)
+	})
+	r.POST("/api/send-config/:name", func(c *gin.Context) {
+		// the update loop doesn't wait for the mail server, sendPeerConfigEmail only holds updateMutex while it builds the email
+		ra := c.Request.RemoteAddr
+		updateMutex.RLock()
+		allowed := canManage(findPeerByIp(strings.Split(ra, ":")[0]), c.Param("name"))
+		peer := findPeerByName(c.Param("name"))
+		updateMutex.RUnlock()
+		if !allowed {
+			c.AbortWithStatus(403)
+			return
+		}
+		if peer == nil {
 			c.AbortWithStatus(400)
 			return
 		}
+		err := sendPeerConfigEmail(peer)
+		if err != nil {
+			c.Error(err)
+			c.JSON(400, map[string]interface{}{"error": err.Error()})
+			return
+		}
 		c.AbortWithStatus(200)
 	})
-	r.GET("/api/configs/:name", func(c *gin.Context) {
+	r.GET("/api/configs/:name", readPeers, func(c *gin.Context) {
+		ra := c.Request.RemoteAddr
+		client := findPeerByIp(strings.Split(ra, ":")[0])
+		// links with an old name resolve to the renamed peer, which is checked by its current name
+		peer := findPeerByAnyName(c.Param("name"))
 		name := c.Param("name")
-		if p := findPeerByName(name); p != nil {
-			c.Data(200, "text/plain", []byte(generateConfig(p)))
-		} else {
+		if peer != nil {
+			name = peer.Name
+		}
+		if !canView(client, name) {
+			c.AbortWithStatus(403)
+			return
+		}
+		if peer == nil {
 			c.AbortWithStatus(400)
+			return
 		}
+		c.Data(200, "text/plain", []byte(generateConfig(peer)))
 	})
-	go func() {
-		fmt.Println(autotls.Run(r), config.Domain)
-	}()
-	if err := r.Run(":80"); err != nil {
-		panic(err)
+	r.GET("/api/configs/:name/qr", readPeers, func(c *gin.Context) {
+		ra := c.Request.RemoteAddr
+		client := findPeerByIp(strings.Split(ra, ":")[0])
+		// links with an old name resolve to the renamed peer, which is checked by its current name
+		peer := findPeerByAnyName(c.Param("name"))
+		name := c.Param("name")
+		if peer != nil {
+			name = peer.Name
+		}
+		if !canView(client, name) {
+			c.AbortWithStatus(403)
+			return
+		}
+		if peer == nil {
+			c.AbortWithStatus(400)
+			return
+		}
+		if c.Query("format") == "svg" {
+			svg, err := peerQRCodeSVG(peer)
+			if err != nil {
+				c.Error(err)
+				c.AbortWithStatus(500)
+				return
+			}
+			c.Data(200, "image/svg+xml", []byte(svg))
+			return
+		}
+		size, _ := strconv.Atoi(c.Query("size"))
+		png, err := peerQRCodePNG(peer, size)
+		if err != nil {
+			c.Error(err)
+			c.AbortWithStatus(500)
+			return
+		}
+		c.Data(200, "image/png", png)
+	})
+	r.GET("/api/configs/:name/zip", readPeers, func(c *gin.Context) {
+		ra := c.Request.RemoteAddr
+		client := findPeerByIp(strings.Split(ra, ":")[0])
+		// links with an old name resolve to the renamed peer, which is checked by its current name
+		peer := findPeerByAnyName(c.Param("name"))
+		name := c.Param("name")
+		if peer != nil {
+			name = peer.Name
+		}
+		if !canView(client, name) {
+			c.AbortWithStatus(403)
+			return
+		}
+		if peer == nil {
+			c.AbortWithStatus(400)
+			return
+		}
+		var buf bytes.Buffer
+		archive := zip.NewWriter(&buf)
+		if err := writePeerBundle(archive, "", peer); err != nil {
+			c.Error(err)
+			c.AbortWithStatus(500)
+			return
+		}
+		if err := archive.Close(); err != nil {
+			c.Error(err)
+			c.AbortWithStatus(500)
+			return
+		}
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.zip"`, peer.Name))
+		c.Data(200, "application/zip", buf.Bytes())
+	})
+	r.GET("/api/group-configs/:group", readPeers, func(c *gin.Context) {
+		ra := c.Request.RemoteAddr
+		client := findPeerByIp(strings.Split(ra, ":")[0])
+		group := c.Param("group")
+		if !canManage(client, group) {
+			c.AbortWithStatus(403)
+			return
+		}
+		var buf bytes.Buffer
+		archive := zip.NewWriter(&buf)
+		for _, p := range config.Peers {
+			if groupOf(p.Name) != group {
+				continue
+			}
+			if err := writePeerBundle(archive, p.Name+"/", p); err != nil {
+				c.Error(err)
+				c.AbortWithStatus(500)
+				return
+			}
+		}
+		if err := archive.Close(); err != nil {
+			c.Error(err)
+			c.AbortWithStatus(500)
+			return
+		}
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.zip"`, group))
+		c.Data(200, "application/zip", buf.Bytes())
+	})
+	if err := runHTTPServers(r); err != nil {
+		return err
 	}
+	<-shutdownDone
+	return nil
 }
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultPeerListLimit and maxPeerListLimit bound the page size of the peer list
+const (
+	defaultPeerListLimit = 50
+	maxPeerListLimit     = 500
+)
+
+// PeerFilter selects peers by their properties, empty fields match every peer and a peer must match all the others
+type PeerFilter struct {
+	// Group matches peers whose name starts with the group and a dash
+	Group     string `json:"group" form:"group"`
+	Interface string `json:"interface" form:"interface"`
+	Role      string `json:"role" form:"role"`
+	// Status is active, suspended or disabled
+	Status string `json:"status" form:"status"`
+	// Tags matches peers with any of the tags
+	Tags []string `json:"tags" form:"tag"`
+	// ExpiresBefore matches peers expiring before the unix time
+	ExpiresBefore uint64 `json:"expiresBefore" form:"expiresBefore"`
+	// UsageAbove matches peers that used more than this percentage of their allowed usage
+	UsageAbove float64 `json:"usageAbove" form:"usageAbove"`
+	// OnlineWithin matches peers with a handshake in the last minutes
+	OnlineWithin int `json:"onlineWithin" form:"onlineWithin"`
+	// Search matches peers whose name or email contains the text, ignoring case
+	Search string `json:"search" form:"search"`
+}
+
+func (f *PeerFilter) empty() bool {
+	return f.Group == "" && f.Interface == "" && f.Role == "" && f.Status == "" && len(f.Tags) == 0 && f.ExpiresBefore == 0 &&
+		f.UsageAbove == 0 && f.OnlineWithin == 0 && f.Search == ""
+}
+
+func (f *PeerFilter) validate() error {
+	if f.Status != "" && f.Status != "active" && f.Status != "suspended" && f.Status != "disabled" {
+		return fmt.Errorf("unknown status %q, use active, suspended or disabled", f.Status)
+	}
+	if f.Role != "" && f.Role != "user" && f.Role != "distributor" && f.Role != "admin" {
+		return fmt.Errorf("unknown role %q", f.Role)
+	}
+	if f.UsageAbove < 0 || f.OnlineWithin < 0 {
+		return errors.New("usageAbove and onlineWithin can't be negative")
+	}
+	return nil
+}
+
+// handshakeCutoff is the earliest handshake of a peer online within the last minutes, 0 when they reach back past 1970
+func handshakeCutoff(minutes int) uint64 {
+	now := time.Now().Unix()
+	if int64(minutes) >= now/60 {
+		return 0
+	}
+	return uint64(now - int64(minutes)*60)
+}
+
+// usagePercent is the share of its allowed usage the peer has used
+func usagePercent(p *Peer) float64 {
+	if p.AllowedUsage == 0 {
+		return 0
+	}
+	return float64(p.TotalUsage) * 100 / float64(p.AllowedUsage)
+}
+
+func (f *PeerFilter) matches(p *Peer) bool {
+	if f.Group != "" && groupOf(p.Name) != f.Group {
+		return false
+	}
+	if f.Interface != "" && peerInterface(p).Name != f.Interface {
+		return false
+	}
+	if f.Role != "" && p.Role != f.Role {
+		return false
+	}
+	if f.Status != "" && peerStatus(p) != f.Status {
+		return false
+	}
+	if len(f.Tags) > 0 && !slices.ContainsFunc(f.Tags, func(tag string) bool { return slices.Contains(p.Tags, tag) }) {
+		return false
+	}
+	if f.ExpiresBefore != 0 && p.ExpiresAt >= f.ExpiresBefore {
+		return false
+	}
+	if f.UsageAbove != 0 && usagePercent(p) <= f.UsageAbove {
+		return false
+	}
+	if f.OnlineWithin != 0 && p.LatestHandshake < handshakeCutoff(f.OnlineWithin) {
+		return false
+	}
+	search := strings.ToLower(f.Search)
+	return search == "" || strings.Contains(strings.ToLower(p.Name), search) || strings.Contains(strings.ToLower(p.Email), search)
+}
+
+// peerSortKeys are the fields the peer list can be sorted by, names break ties
+var peerSortKeys = map[string]func(p *Peer) float64{
+	"expiresAt":       func(p *Peer) float64 { return float64(p.ExpiresAt) },
+	"totalUsage":      func(p *Peer) float64 { return float64(p.TotalUsage) },
+	"usagePercent":    usagePercent,
+	"latestHandshake": func(p *Peer) float64 { return float64(p.LatestHandshake) },
+	"createdAt":       func(p *Peer) float64 { return float64(p.ID.Timestamp().Unix()) },
+}
+
+type PeerListQuery struct {
+	PeerFilter
+	// Sort is name or one of peerSortKeys, a leading dash sorts descending
+	Sort   string `form:"sort"`
+	Limit  int    `form:"limit"`
+	Cursor string `form:"cursor"`
+}
+
+type PeerList struct {
+	Peers []*Peer `json:"peers"`
+	// Total is how many peers match the filter on all pages
+	Total int `json:"total"`
+	// NextCursor fetches the next page, it is empty on the last one
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// peerCursor is the position after the last peer of a page, so pages stay consistent when peers are added or removed
+type peerCursor struct {
+	Sort  string  `json:"s"`
+	Value float64 `json:"v"`
+	Name  string  `json:"n"`
+}
+
+// listPeers returns a page of the peers client may see that match the query
+func listPeers(client *Peer, q *PeerListQuery) (*PeerList, error) {
+	if err := q.PeerFilter.validate(); err != nil {
+		return nil, err
+	}
+	if q.Limit == 0 {
+		q.Limit = defaultPeerListLimit
+	}
+	if q.Limit < 1 || q.Limit > maxPeerListLimit {
+		return nil, fmt.Errorf("limit must be between 1 and %d", maxPeerListLimit)
+	}
+	if q.Sort == "" {
+		q.Sort = "name"
+	}
+	field, descending := strings.TrimPrefix(q.Sort, "-"), strings.HasPrefix(q.Sort, "-")
+	key := func(p *Peer) float64 { return 0 }
+	if field != "name" {
+		if key = peerSortKeys[field]; key == nil {
+			return nil, fmt.Errorf("can't sort by %q, use name, expiresAt, totalUsage, usagePercent, latestHandshake or createdAt", field)
+		}
+	}
+	// before reports whether a peer with value a and name an comes before one with b and bn
+	before := func(a float64, an string, b float64, bn string) bool {
+		if a != b {
+			return a < b != descending
+		}
+		return an != bn && an < bn != descending
+	}
+
+	var after *peerCursor
+	if q.Cursor != "" {
+		after = &peerCursor{}
+		data, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+		if err == nil {
+			err = json.Unmarshal(data, after)
+		}
+		if err != nil || after.Sort != q.Sort {
+			return nil, errors.New("invalid cursor, it belongs to another sort order or is damaged")
+		}
+	}
+
+	peers := []*Peer{}
+	for _, p := range config.Peers {
+		if canView(client, p.Name) && q.PeerFilter.matches(p) {
+			peers = append(peers, p)
+		}
+	}
+	sort.Slice(peers, func(i, j int) bool { return before(key(peers[i]), peers[i].Name, key(peers[j]), peers[j].Name) })
+
+	list := &PeerList{Total: len(peers), Peers: []*Peer{}}
+	start := 0
+	if after != nil {
+		start = sort.Search(len(peers), func(i int) bool { return before(after.Value, after.Name, key(peers[i]), peers[i].Name) })
+	}
+	end := min(start+q.Limit, len(peers))
+	list.Peers = append(list.Peers, peers[start:end]...)
+	if end < len(peers) {
+		last := peers[end-1]
+		data, _ := json.Marshal(peerCursor{Sort: q.Sort, Value: key(last), Name: last.Name})
+		list.NextCursor = base64.RawURLEncoding.EncodeToString(data)
+	}
+	return list, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+func peerNames(peers []*Peer) []string {
+	names := []string{}
+	for _, p := range peers {
+		names = append(names, p.Name)
+	}
+	return names
+}
+
+// listAllPeers follows the cursors of a query and returns the names on each page
+func listAllPeers(t *testing.T, client *Peer, q PeerListQuery) [][]string {
+	t.Helper()
+	var pages [][]string
+	for {
+		list, err := listPeers(client, &q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages = append(pages, peerNames(list.Peers))
+		if list.NextCursor == "" {
+			return pages
+		}
+		q.Cursor = list.NextCursor
+	}
+}
+
+func TestListPeersSortAndPages(t *testing.T) {
+	useTestConfig(t)
+	admin := &Peer{Name: "Admin-0", PublicKey: "pk-admin", Role: "admin"}
+	config.Peers[admin.PublicKey] = admin
+	for _, p := range []*Peer{
+		{Name: "shop-1", TotalUsage: 30, LatestHandshake: 100},
+		{Name: "shop-2", TotalUsage: 10, LatestHandshake: 300},
+		{Name: "shop-3", TotalUsage: 30, LatestHandshake: 200},
+		{Name: "shop-4", TotalUsage: 20},
+		{Name: "cafe-1", TotalUsage: 40, Role: "distributor"},
+	} {
+		p.PublicKey = "pk-" + p.Name
+		config.Peers[p.PublicKey] = p
+	}
+
+	tests := []struct {
+		sort  string
+		limit int
+		want  [][]string
+	}{
+		{"", 2, [][]string{{"Admin-0", "cafe-1"}, {"shop-1", "shop-2"}, {"shop-3", "shop-4"}}},
+		{"-name", 4, [][]string{{"shop-4", "shop-3", "shop-2", "shop-1"}, {"cafe-1", "Admin-0"}}},
+		// names break ties, in the same direction as the sort
+		{"totalUsage", 3, [][]string{{"Admin-0", "shop-2", "shop-4"}, {"shop-1", "shop-3", "cafe-1"}}},
+		{"-totalUsage", 2, [][]string{{"cafe-1", "shop-3"}, {"shop-1", "shop-4"}, {"shop-2", "Admin-0"}}},
+		{"-latestHandshake", 10, [][]string{{"shop-2", "shop-3", "shop-1", "shop-4", "cafe-1", "Admin-0"}}},
+	}
+	for _, test := range tests {
+		got := listAllPeers(t, admin, PeerListQuery{Sort: test.sort, Limit: test.limit})
+		if !slices.EqualFunc(got, test.want, slices.Equal) {
+			t.Errorf("sort %q with limit %d gave pages %q, want %q", test.sort, test.limit, got, test.want)
+		}
+	}
+
+	// a distributor only sees its group
+	cafe := config.Peers["pk-cafe-1"]
+	if got := listAllPeers(t, cafe, PeerListQuery{}); !slices.EqualFunc(got, [][]string{{"cafe-1"}}, slices.Equal) {
+		t.Errorf("distributor got %q", got)
+	}
+}
+
+func TestListPeersCursor(t *testing.T) {
+	useTestConfig(t)
+	admin := &Peer{Name: "Admin-0", PublicKey: "pk-admin", Role: "admin"}
+	config.Peers[admin.PublicKey] = admin
+	for _, name := range []string{"shop-1", "shop-2", "shop-3", "shop-4"} {
+		config.Peers["pk-"+name] = &Peer{Name: name, PublicKey: "pk-" + name}
+	}
+
+	first, err := listPeers(admin, &PeerListQuery{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Total != 5 || first.NextCursor == "" {
+		t.Fatalf("first page is %+v", first)
+	}
+	// the next page starts after the last peer of the first, even when peers before it are gone
+	delete(config.Peers, "pk-admin")
+	config.Peers["pk-shop-0"] = &Peer{Name: "shop-0", PublicKey: "pk-shop-0"}
+	second, err := listPeers(admin, &PeerListQuery{Limit: 2, Cursor: first.NextCursor})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := peerNames(second.Peers); !slices.Equal(got, []string{"shop-2", "shop-3"}) {
+		t.Errorf("second page is %q, want shop-2 and shop-3", got)
+	}
+
+	for _, q := range []PeerListQuery{
+		{Sort: "totalUsage", Cursor: first.NextCursor},
+		{Cursor: "not a cursor"},
+		{Sort: "password"},
+		{Limit: maxPeerListLimit + 1},
+	} {
+		if _, err := listPeers(admin, &q); err == nil {
+			t.Errorf("query %+v was accepted", q)
+		}
+	}
+}
+
+func TestListPeersOnlineWithin(t *testing.T) {
+	useTestConfig(t)
+	admin := &Peer{Name: "Admin-0", PublicKey: "pk-admin", Role: "admin", LatestHandshake: 1}
+	config.Peers[admin.PublicKey] = admin
+
+	// minutes reaching back past 1970 match every handshake instead of wrapping around
+	for _, minutes := range []int{60 * 24 * 365 * 100, math.MaxInt} {
+		list, err := listPeers(admin, &PeerListQuery{PeerFilter: PeerFilter{OnlineWithin: minutes}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list.Peers) != 1 {
+			t.Errorf("onlineWithin %d matched %d peers, want 1", minutes, len(list.Peers))
+		}
+	}
+	list, err := listPeers(admin, &PeerListQuery{PeerFilter: PeerFilter{OnlineWithin: 5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Peers) != 0 {
+		t.Errorf("a handshake in 1970 is online within 5 minutes")
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/skip2/go-qrcode"
+)
+
+const defaultQRCodeSize = 512
+
+func peerQRCodePNG(peer *Peer, size int) ([]byte, error) {
+	if size <= 0 || size > 2048 {
+		size = defaultQRCodeSize
+	}
+	return qrcode.Encode(generateConfig(peer), qrcode.Medium, size)
+}
+
+// peerQRCodeSVG renders the peer's config as an svg QR code with one unit per module
+func peerQRCodeSVG(peer *Peer) (string, error) {
+	q, err := qrcode.New(generateConfig(peer), qrcode.Medium)
+	if err != nil {
+		return "", err
+	}
+	bitmap := q.Bitmap()
+	var path strings.Builder
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&path, "M%d %dh1v1h-1z", x, y)
+			}
+		}
+	}
+	return fmt.Sprintf(
+		`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges"><rect width="100%%" height="100%%" fill="#fff"/><path fill="#000" d="%s"/></svg>`,
+		len(bitmap), len(bitmap), path.String()), nil
+}
+
+// writePeerBundle adds the peer's config file and QR code to the archive, prefixed with dir
+func writePeerBundle(archive *zip.Writer, dir string, peer *Peer) error {
+	qr, err := peerQRCodePNG(peer, defaultQRCodeSize)
+	if err != nil {
+		return err
+	}
+	f, err := archive.Create(dir + peer.Name + ".conf")
+	if err != nil {
+		return err
+	}
+	if _, err = io.WriteString(f, generateConfig(peer)); err != nil {
+		return err
+	}
+	f, err = archive.Create(dir + peer.Name + ".png")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(qr)
+	return err
+}
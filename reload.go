@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"text/template"
+	"time"
+)
+
+// configFile is the path the running config was loaded from, reloads read it again
+var configFile string
+
+// reloadMutex keeps reloads from the api and SIGHUP from running at the same time
+var reloadMutex sync.Mutex
+
+// updateMutex guards config.Peers, config.Trash, the peers in them, the interfaces' config files and the settings a
+// reload changes. Whatever changes them holds it, whatever only reads them holds its read lock. Shutdown holds it to
+// wait for the running update and flush the last one.
+var updateMutex sync.RWMutex
+
+// shutdownDone is closed once shutdown has flushed usage and stopped the listeners
+var shutdownDone = make(chan struct{})
+
+type ReloadResult struct {
+	// Applied lists the settings that changed and are in effect now
+	Applied []string `json:"applied"`
+	// RestartRequired lists the settings that changed but only take effect after a restart
+	RestartRequired []string `json:"restartRequired"`
+}
+
+type interfaceIdentity struct {
+	Name           string
+	PublicKey      string
+	NetworkAddress string
+	ListenPort     int
+}
+
+type nodeIdentity struct {
+	Name  string
+	URL   string
+	Token string
+}
+
+// reloadConfig reads the config file again and applies what can be changed without restarting.
+// The running config is left untouched if the file has problems.
+func reloadConfig() (*ReloadResult, error) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	c, err := readConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+	var clientTemplate *template.Template
+	if c.ClientConfigTemplate != "" {
+		if clientTemplate, err = parseClientConfigTemplate(c.ClientConfigTemplate); err != nil {
+			return nil, err
+		}
+	} else {
+		clientTemplate = template.Must(template.New("client").Parse(defaultClientConfigTemplate))
+	}
+
+	// handlers, the update loop and the telegram bot read the settings under updateMutex
+	updateMutex.Lock()
+	defer updateMutex.Unlock()
+
+	result := &ReloadResult{Applied: []string{}, RestartRequired: []string{}}
+	restart := func(name string, old interface{}, new interface{}) {
+		if !reflect.DeepEqual(old, new) {
+			result.RestartRequired = append(result.RestartRequired, name)
+		}
+	}
+	apply := func(name string, old interface{}, new interface{}) bool {
+		if reflect.DeepEqual(old, new) {
+			return false
+		}
+		result.Applied = append(result.Applied, name)
+		return true
+	}
+
+	restart("mongoURI", config.MongoURI, c.MongoURI)
+	restart("dbName", config.DBName, c.DBName)
+	restart("collectionName", config.CollectionName, c.CollectionName)
+	restart("webhookDeliveriesCollectionName", config.WebhookDeliveriesCollectionName, c.WebhookDeliveriesCollectionName)
+	restart("path", config.Path, c.Path)
+	restart("http", config.HTTP, c.HTTP)
+	restart("agentAddress", config.AgentAddress, c.AgentAddress)
+	restart("agentCertFile", config.AgentCertFile, c.AgentCertFile)
+	restart("agentKeyFile", config.AgentKeyFile, c.AgentKeyFile)
+	restart("log.format", config.Log.Format, c.Log.Format)
+	nodes := func(list []*Node) []nodeIdentity {
+		var ids []nodeIdentity
+		for _, n := range list {
+			ids = append(ids, nodeIdentity{n.Name, n.URL, n.Token})
+		}
+		return ids
+	}
+	restart("nodes", nodes(config.Nodes), nodes(c.Nodes))
+
+	// interfaces can only be changed live as long as the same ones with the same addresses and keys are configured
+	interfaces := func(list []*Interface) []interfaceIdentity {
+		var ids []interfaceIdentity
+		for _, i := range list {
+			ids = append(ids, interfaceIdentity{i.Name, i.PublicKey, i.NetworkAddress, i.ListenPort})
+		}
+		return ids
+	}
+	if !reflect.DeepEqual(interfaces(config.Interfaces), interfaces(c.Interfaces)) {
+		result.RestartRequired = append(result.RestartRequired, "interfaces")
+	} else {
+		changed := false
+		for i, iface := range config.Interfaces {
+			if iface.Endpoint != c.Interfaces[i].Endpoint || iface.DNSServers != c.Interfaces[i].DNSServers {
+				iface.Endpoint = c.Interfaces[i].Endpoint
+				iface.DNSServers = c.Interfaces[i].DNSServers
+				changed = true
+			}
+		}
+		if changed {
+			result.Applied = append(result.Applied, "interfaces")
+		}
+	}
+
+	if apply("dnsServers", config.DNSServers, c.DNSServers) {
+		config.DNSServers = c.DNSServers
+	}
+	if apply("plans", config.Plans, c.Plans) {
+		config.Plans = c.Plans
+	}
+	if apply("maxTelegramSubscribers", config.MaxTelegramSubscribers, c.MaxTelegramSubscribers) {
+		config.MaxTelegramSubscribers = c.MaxTelegramSubscribers
+	}
+	if apply("telegramOperatorSecret", config.TelegramOperatorSecret, c.TelegramOperatorSecret) {
+		config.TelegramOperatorSecret = c.TelegramOperatorSecret
+	}
+	if apply("webhooks", config.Webhooks, c.Webhooks) {
+		config.Webhooks = c.Webhooks
+	}
+	if apply("smtp", config.SMTP, c.SMTP) {
+		config.SMTP = c.SMTP
+	}
+	if apply("groupClientSettings", config.GroupClientSettings, c.GroupClientSettings) {
+		config.GroupClientSettings = c.GroupClientSettings
+	}
+	apply("clientConfigTemplate", config.ClientConfigTemplate, c.ClientConfigTemplate)
+	config.ClientConfigTemplate = c.ClientConfigTemplate
+	clientConfigTemplate = clientTemplate
+	if apply("expiryNoticeDays", config.ExpiryNoticeDays, c.ExpiryNoticeDays) {
+		config.ExpiryNoticeDays = c.ExpiryNoticeDays
+	}
+	if apply("usageNoticeBytes", config.UsageNoticeBytes, c.UsageNoticeBytes) {
+		config.UsageNoticeBytes = c.UsageNoticeBytes
+	}
+	if apply("log.level", config.Log.Level, c.Log.Level) {
+		config.Log.Level = c.Log.Level
+		level, _ := parseLogLevel(c.Log.Level)
+		logLevel.Set(level)
+	}
+	if apply("maxUpdateAge", config.MaxUpdateAge, c.MaxUpdateAge) {
+		config.MaxUpdateAge = c.MaxUpdateAge
+	}
+	if apply("backup", config.Backup, c.Backup) {
+		config.Backup = c.Backup
+	}
+	if apply("trashDays", config.TrashDays, c.TrashDays) {
+		config.TrashDays = c.TrashDays
+	}
+	if apply("agentToken", config.AgentToken, c.AgentToken) {
+		config.AgentToken = c.AgentToken
+	}
+	if apply("telegramBotToken", config.TelegramBotToken, c.TelegramBotToken) {
+		config.TelegramBotToken = c.TelegramBotToken
+		// the old bot's update loop ends when it stops receiving updates
+		if config.TelegramBot != nil {
+			config.TelegramBot.StopReceivingUpdates()
+		}
+		go runTelegramBot()
+	}
+	return result, nil
+}
+
+// handleSignals reloads the config on SIGHUP and shuts down gracefully on SIGTERM and SIGINT
+func handleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
+	for s := range signals {
+		if s != syscall.SIGHUP {
+			shutdown()
+			return
+		}
+		sdNotify("RELOADING=1")
+		result, err := reloadConfig()
+		sdNotify("READY=1")
+		if err != nil {
+			slog.Error("reload failed, keeping the running config", "error", err)
+			continue
+		}
+		slog.Info("config reloaded", "applied", result.Applied, "restartRequired", result.RestartRequired)
+	}
+}
+
+// shutdown records the usage since the last update, stops the listeners and waits briefly for webhook deliveries
+func shutdown() {
+	slog.Info("shutting down")
+	sdNotify("STOPPING=1")
+
+	// wait for the running update and keep the loop from starting another
+	updateMutex.Lock()
+	updatePeers()
+	if err := flushQueuedWrites(true); err != nil {
+		slog.Error("could not write queued changes", "pendingWrites", storeStatus().PendingWrites, "error", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, s := range httpServers {
+		if err := s.Shutdown(ctx); err != nil {
+			slog.Warn("listener did not shut down cleanly", "address", s.Addr, "error", err)
+		}
+	}
+
+	delivered := make(chan struct{})
+	go func() {
+		pendingWebhooks.Wait()
+		close(delivered)
+	}()
+	select {
+	case <-delivered:
+	case <-ctx.Done():
+		slog.Warn("gave up waiting for webhook deliveries")
+	}
+	close(shutdownDone)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// maxPeerNameLength keeps names short enough for Telegram buttons, whose data is limited to 64 bytes
+const maxPeerNameLength = 48
+
+// NameChange is one rename of a peer, kept so links and log entries with the old name can still be resolved
+type NameChange struct {
+	From      string `bson:"from" json:"from"`
+	To        string `bson:"to" json:"to"`
+	ChangedAt uint64 `bson:"changedAt" json:"changedAt"`
+	ChangedBy string `bson:"changedBy" json:"changedBy"`
+}
+
+// validatePeerName checks that a name is safe in URLs, file names and Telegram buttons:
+// letters, digits, dots, underscores and dashes, starting with a letter or digit
+func validatePeerName(name string) error {
+	if name == "" || len(name) > maxPeerNameLength {
+		return fmt.Errorf("name must be 1 to %d characters long", maxPeerNameLength)
+	}
+	for i, r := range name {
+		alphanumeric := r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9'
+		if i == 0 && !alphanumeric {
+			return errors.New("name must start with a letter or digit")
+		}
+		if !alphanumeric && r != '.' && r != '_' && r != '-' {
+			return fmt.Errorf("name can't contain %q, use letters, digits, dots, underscores and dashes", r)
+		}
+	}
+	return nil
+}
+
+// sanitizePeerName turns a name from another tool into one validatePeerName accepts by replacing every other character
+// with a dash. It returns an empty string if nothing usable is left.
+func sanitizePeerName(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		alphanumeric := r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9'
+		switch {
+		case alphanumeric || (r == '.' || r == '_' || r == '-') && b.Len() > 0:
+			b.WriteRune(r)
+		case b.Len() > 0 && !strings.HasSuffix(b.String(), "-"):
+			b.WriteRune('-')
+		}
+	}
+	sanitized := b.String()
+	if len(sanitized) > maxPeerNameLength {
+		sanitized = sanitized[:maxPeerNameLength]
+	}
+	return strings.TrimRight(sanitized, "-")
+}
+
+// validateRename checks that client may give the peer the new name
+func validateRename(client *Peer, peer *Peer, name string) error {
+	if err := validatePeerName(name); err != nil {
+		return err
+	}
+	if other := findPeerByName(name); other != nil && other != peer {
+		return errors.New("name is taken by another peer")
+	}
+	// distributors manage peers by the group in their names, a rename can't move a peer out of it
+	if !canManage(client, name) {
+		return fmt.Errorf("peers of group %s can't be renamed into group %s", groupOf(peer.Name), groupOf(name))
+	}
+	return nil
+}
+
+// renameChange records the rename of the peer to name by actor in its history and returns the change
+func renameChange(peer *Peer, name string, actor string) NameChange {
+	change := NameChange{From: peer.Name, To: name, ChangedAt: uint64(time.Now().Unix()), ChangedBy: actor}
+	peer.Name = name
+	peer.NameHistory = append(peer.NameHistory, change)
+	return change
+}
+
+// findPeerByAnyName returns the peer with the name, or else the peer most recently renamed from it
+func findPeerByAnyName(name string) *Peer {
+	if p := findPeerByName(name); p != nil {
+		return p
+	}
+	var found *Peer
+	var renamedAt uint64
+	for _, p := range config.Peers {
+		for _, change := range p.NameHistory {
+			if change.From == name && change.ChangedAt >= renamedAt {
+				found, renamedAt = p, change.ChangedAt
+			}
+		}
+	}
+	return found
+}
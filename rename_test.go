@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidatePeerName(t *testing.T) {
+	valid := []string{"shop-12", "a", "7", "Shop_1.b-2", "shop-", strings.Repeat("a", maxPeerNameLength)}
+	for _, name := range valid {
+		if err := validatePeerName(name); err != nil {
+			t.Errorf("%q was rejected: %v", name, err)
+		}
+	}
+	invalid := []string{"", strings.Repeat("a", maxPeerNameLength+1), "-shop", ".shop", "_shop", "shop 12", "shop/12", "a?b", "shop#1", "فروشگاه-1", "shop-۱"}
+	for _, name := range invalid {
+		if validatePeerName(name) == nil {
+			t.Errorf("%q was accepted", name)
+		}
+	}
+}
+
+func TestSanitizePeerName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"shop-12", "shop-12"},
+		{"shop 12", "shop-12"},
+		{"  shop  12  ", "shop-12"},
+		{"a//b?c", "a-b-c"},
+		{"-shop.1_b", "shop.1_b"},
+		{"x!!", "x"},
+		{"فروشگاه-1", "1"},
+		{"علی رضا", ""},
+		{"---", ""},
+		{"", ""},
+		{strings.Repeat("a", 60), strings.Repeat("a", maxPeerNameLength)},
+		// a dash left at the end by cutting the name is dropped
+		{strings.Repeat("a", maxPeerNameLength-1) + " b", strings.Repeat("a", maxPeerNameLength-1)},
+	}
+	for _, test := range tests {
+		got := sanitizePeerName(test.name)
+		if got != test.want {
+			t.Errorf("sanitizePeerName(%q) is %q, want %q", test.name, got, test.want)
+		}
+		if got != "" && validatePeerName(got) != nil {
+			t.Errorf("sanitizePeerName(%q) gave %q, which isn't valid", test.name, got)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// maxRotationGrace is the longest the old keypair of a rotated peer can stay connected
+const maxRotationGrace = 24 * time.Hour
+
+type RotateRequest struct {
+	// Keypair and PresharedKey choose what is replaced, both are when neither is set
+	Keypair      bool `json:"keypair"`
+	PresharedKey bool `json:"presharedKey"`
+	// GraceMinutes keeps the old keypair connected for that long. Wireguard can't route one address to two keys,
+	// so the old keypair keeps the address and the new one gets another.
+	GraceMinutes int `json:"graceMinutes"`
+	// Notify sends the new config to the peer's Telegram chats and email address, defaults to true
+	Notify *bool `json:"notify"`
+}
+
+// RotateResponse is a rotated peer. PreviousAddress is set when a grace period moved the peer to a new address.
+type RotateResponse struct {
+	*Peer
+	PreviousAddress string `json:"previousAddress,omitempty"`
+}
+
+// RetiredKey is a rotated peer's old keypair that stays on the interface until ValidUntil
+type RetiredKey struct {
+	PublicKey    string `bson:"publicKey" json:"publicKey"`
+	PresharedKey string `bson:"presharedKey" json:"-"`
+	Address      string `bson:"address" json:"address"`
+	ValidUntil   uint64 `bson:"validUntil" json:"validUntil"`
+	// TotalRx is the device's counter of the key when its usage was last counted, counted is false until it is known
+	TotalRx uint64 `bson:"-" json:"-"`
+	counted bool
+}
+
+// rotatePeerKeys gives the peer new keys and applies them to its interface with one sync. The peer keeps its name,
+// limits and usage, its clients need the new config. It keeps its address too, unless the old keypair stays valid for a
+// grace period: the old keypair keeps the address then, and the peer moves to a new one that RotateResponse reports.
+// The caller holds updateMutex.
+func rotatePeerKeys(peer *Peer, req *RotateRequest) error {
+	if !req.Keypair && !req.PresharedKey {
+		req.Keypair, req.PresharedKey = true, true
+	}
+	grace := time.Duration(req.GraceMinutes) * time.Minute
+	switch {
+	case grace < 0 || grace > maxRotationGrace:
+		return fmt.Errorf("graceMinutes must be between 0 and %d", int(maxRotationGrace.Minutes()))
+	case grace > 0 && !req.Keypair:
+		return errors.New("only a rotated keypair can stay valid for a grace period")
+	case grace > 0 && peer.Suspended:
+		return errors.New("the old keypair of a suspended peer can't stay valid")
+	}
+
+	privateKey, publicKey := peer.PrivateKey, peer.PublicKey
+	if req.Keypair {
+		privateKeyBytes, err := exec.Command("wg", "genkey").Output()
+		if err != nil {
+			return err
+		}
+		privateKey = strings.TrimSpace(string(privateKeyBytes))
+		if publicKey, err = wgPubkey(privateKey); err != nil {
+			return err
+		}
+	}
+	presharedKey := peer.PresharedKey
+	if req.PresharedKey {
+		presharedKeyBytes, err := exec.Command("wg", "genpsk").Output()
+		if err != nil {
+			return err
+		}
+		presharedKey = strings.TrimSpace(string(presharedKeyBytes))
+	}
+
+	iface := peerInterface(peer)
+	previousConfig, err := os.ReadFile(iface.ConfigPath())
+	if err != nil {
+		return err
+	}
+	address := peer.Address
+	var retired *RetiredKey
+	if grace > 0 {
+		if address, err = unusedAddress(iface, ""); err != nil {
+			return err
+		}
+		retired = &RetiredKey{
+			PublicKey:    peer.PublicKey,
+			PresharedKey: peer.PresharedKey,
+			Address:      peer.Address,
+			ValidUntil:   uint64(time.Now().Add(grace).Unix()),
+			TotalRx:      peer.TotalRx,
+			counted:      true,
+		}
+	}
+
+	// a key retired by an earlier rotation goes now, the current one stays only for a grace period
+	remove := map[string]bool{}
+	if peer.RetiredKey != nil {
+		remove[peer.RetiredKey.PublicKey] = true
+	}
+	if retired == nil {
+		remove[peer.PublicKey] = true
+	}
+	writtenKey := presharedKey
+	if peer.Suspended {
+		writtenKey = invalidPresharedKey(peer)
+	}
+	newConfig := strings.TrimRight(removePeerSections(string(previousConfig), remove), "\n") + "\n" +
+		fmt.Sprintf("\n[Peer]\nPublicKey = %s\nPresharedKey = %s\nAllowedIPs = %s\n", publicKey, writtenKey, address)
+	if err = os.WriteFile(iface.ConfigPath(), []byte(newConfig), 0644); err != nil {
+		return err
+	}
+	// put the old keys back on the device if the new ones can't be stored
+	undo := func() {
+		os.WriteFile(iface.ConfigPath(), previousConfig, 0644)
+		if err := iface.Sync(); err != nil {
+			slog.Error("could not restore the keys of peer", peerLog(peer), "interface", iface.Name, "error", err)
+		}
+	}
+	if err = iface.Sync(); err != nil {
+		undo()
+		return err
+	}
+
+	update := bson.M{"$set": bson.M{"privatekey": privateKey, "publicKey": publicKey, "presharedKey": presharedKey, "address": address}}
+	if retired != nil {
+		update["$set"].(bson.M)["retiredKey"] = retired
+	} else {
+		update["$unset"] = bson.M{"retiredKey": ""}
+	}
+	if _, err = config.Collection.UpdateOne(context.TODO(), bson.M{"publicKey": peer.PublicKey}, update); err != nil {
+		undo()
+		return err
+	}
+
+	oldPublicKey := peer.PublicKey
+	delete(config.Peers, oldPublicKey)
+	peer.PrivateKey, peer.PublicKey, peer.PresharedKey, peer.Address = privateKey, publicKey, presharedKey, address
+	peer.RetiredKey = retired
+	config.Peers[peer.PublicKey] = peer
+	if req.Keypair {
+		// the device counts the new key's transfer from zero
+		peer.TotalRx, peer.TotalTx = 0, 0
+	}
+	slog.Info("rotated peer keys", peerLog(peer), "oldPublicKey", oldPublicKey, "keypair", req.Keypair, "presharedKey", req.PresharedKey, "grace", grace.String())
+	emitWebhook(webhookPeerKeysRotated, peer, map[string]interface{}{"oldPublicKey": oldPublicKey, "keypair": req.Keypair, "presharedKey": req.PresharedKey})
+
+	if req.Notify == nil || *req.Notify {
+		go notifyRotatedPeer(peer, grace)
+	}
+	return nil
+}
+
+// notifyRotatedPeer sends the new config of a rotated peer to its Telegram chats and email address. The messages are
+// built under updateMutex and sent without it, so the update loop doesn't wait for Telegram or the mail server.
+func notifyRotatedPeer(peer *Peer, grace time.Duration) {
+	updateMutex.RLock()
+	text := fmt.Sprintf(`کلیدهای اشتراک "%s" تغییر کرد، کانفیگ جدید را وارد کنید`, peer.Name)
+	if grace > 0 {
+		text = fmt.Sprintf(`کلیدهای اشتراک "%s" تغییر کرد، کانفیگ قبلی تا %d دقیقه دیگر کار میکند`, peer.Name, int(grace.Minutes()))
+	}
+	bot := config.TelegramBot
+	var notices []telegramNotice
+	if bot != nil {
+		for _, chatID := range peer.TelegramChatIDs {
+			notices = append(notices, telegramNotice{chatID, tgbotapi.NewMessage(chatID, text)})
+			for _, c := range telegramPeerConfig(chatID, peer) {
+				notices = append(notices, telegramNotice{chatID, c})
+			}
+		}
+	}
+	email, log := config.SMTP != nil && peer.Email != "", peerLog(peer)
+	updateMutex.RUnlock()
+
+	if len(notices) > 0 {
+		// dead chats are unlinked from the peer, like when the update loop notifies them
+		sendTelegramNotices(bot, notices, log)
+	}
+	if email {
+		if err := sendPeerConfigEmail(peer); err != nil {
+			slog.Error("could not email config", log, "error", err)
+		}
+	}
+}
+
+// retiredKeyOwner returns the peer whose retired key has the public key
+func retiredKeyOwner(publicKey string) *Peer {
+	for _, p := range config.Peers {
+		if p.RetiredKey != nil && p.RetiredKey.PublicKey == publicKey {
+			return p
+		}
+	}
+	return nil
+}
+
+// countRetiredKeyUsage adds the transfer of a retired key in a line of the device dump to its peer's usage
+func countRetiredKeyUsage(publicKey string, info []string) {
+	peer := retiredKeyOwner(publicKey)
+	if peer == nil || len(info) < 7 {
+		return
+	}
+	totalRx, _ := strconv.ParseUint(info[6], 10, 64)
+	// after a restart the counter is only known from the first dump on
+	if peer.RetiredKey.counted && totalRx > peer.RetiredKey.TotalRx {
+		peer.TotalUsage += totalRx - peer.RetiredKey.TotalRx
+		queueUsage(peer, totalRx-peer.RetiredKey.TotalRx)
+	}
+	peer.RetiredKey.TotalRx = totalRx
+	peer.RetiredKey.counted = true
+}
+
+// dropRetiredKeys takes retired keys off their interfaces once their grace period is over, or when their peer was suspended
+func dropRetiredKeys() {
+	now := uint64(time.Now().Unix())
+	expired := map[*Interface][]*Peer{}
+	for _, p := range config.Peers {
+		if p.RetiredKey != nil && (p.RetiredKey.ValidUntil <= now || p.Suspended) {
+			iface := peerInterface(p)
+			expired[iface] = append(expired[iface], p)
+		}
+	}
+	for iface, peers := range expired {
+		publicKeys := map[string]bool{}
+		for _, p := range peers {
+			publicKeys[p.RetiredKey.PublicKey] = true
+		}
+		configBytes, err := os.ReadFile(iface.ConfigPath())
+		if err == nil {
+			err = os.WriteFile(iface.ConfigPath(), []byte(removePeerSections(string(configBytes), publicKeys)), 0644)
+		}
+		if err == nil {
+			err = iface.Sync()
+		}
+		if err != nil {
+			slog.Error("could not remove retired keys", "interface", iface.Name, "error", err)
+			continue
+		}
+		for _, p := range peers {
+			slog.Info("removed retired key", peerLog(p), "retiredPublicKey", p.RetiredKey.PublicKey)
+			p.RetiredKey = nil
+			queueFields(p, bson.M{"retiredKey": nil})
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+const interfaceConfigTemplate = `[Interface]
+Address = {{.Address}}
+ListenPort = {{.ListenPort}}
+PrivateKey = {{.PrivateKey}}
+PostUp = sysctl -w net.ipv4.ip_forward=1; iptables -A FORWARD -i %i -j ACCEPT; iptables -A FORWARD -o %i -j ACCEPT; iptables -t nat -A POSTROUTING -s {{.Network}} -o {{.Outbound}} -j MASQUERADE
+PostDown = iptables -D FORWARD -i %i -j ACCEPT; iptables -D FORWARD -o %i -j ACCEPT; iptables -t nat -D POSTROUTING -s {{.Network}} -o {{.Outbound}} -j MASQUERADE
+`
+
+type interfaceConfigData struct {
+	Address    string
+	Network    string
+	ListenPort int
+	PrivateKey string
+	Outbound   string
+}
+
+// defaultOutboundInterface returns the device of the default route
+func defaultOutboundInterface() (string, error) {
+	out, err := exec.Command("ip", "route", "show", "default").Output()
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(string(out))
+	for i, f := range fields {
+		if f == "dev" && i+1 < len(fields) {
+			return fields[i+1], nil
+		}
+	}
+	return "", errors.New("no default route")
+}
+
+// runSetup generates the server keypair, writes the interface config and a matching config.json, and optionally brings the interface up
+func runSetup(args []string) error {
+	flags := flag.NewFlagSet("init", flag.ExitOnError)
+	interfaceName := flags.String("interface", "wg0", "name of the wireguard interface")
+	address := flags.String("address", "10.8.0.1/24", "address and subnet of the server on the interface")
+	listenPort := flags.Int("port", 51820, "udp port the interface listens on")
+	outbound := flags.String("outbound", "", "interface used for NAT, defaults to the device of the default route")
+	endpoint := flags.String("endpoint", "", "public host name or ip address clients connect to")
+	dnsServers := flags.String("dns", "1.1.1.1,8.8.8.8", "comma separated dns servers for clients")
+	mongoURI := flags.String("mongo-uri", "", "mongodb connection string")
+	dbName := flags.String("db", "wgdb", "mongodb database name")
+	collectionName := flags.String("collection", "peers", "mongodb collection name")
+	path := flags.String("path", "", "wireguard-ui folder, defaults to the current directory")
+	configPath := flags.String("config", "", "where to write config.json, defaults to config.json in the wireguard-ui folder")
+	up := flags.Bool("up", false, "bring the interface up and enable it on boot")
+	force := flags.Bool("force", false, "overwrite existing files")
+	flags.Parse(args)
+
+	// validate options
+	prefix, err := netip.ParsePrefix(*address)
+	if err != nil || !prefix.Addr().Is4() {
+		return fmt.Errorf("invalid address %q, expected ipv4 cidr like 10.8.0.1/24", *address)
+	}
+	if *listenPort < 1 || *listenPort > 65535 {
+		return fmt.Errorf("invalid port %d", *listenPort)
+	}
+	if *endpoint == "" {
+		return errors.New("-endpoint is required")
+	}
+	for _, dns := range splitList(*dnsServers) {
+		if _, err := netip.ParseAddr(dns); err != nil {
+			return fmt.Errorf("invalid dns server %q", dns)
+		}
+	}
+	if *outbound == "" {
+		if *outbound, err = defaultOutboundInterface(); err != nil {
+			return fmt.Errorf("could not detect outbound interface, pass -outbound: %s", err)
+		}
+	}
+	if *path == "" {
+		if *path, err = os.Getwd(); err != nil {
+			return err
+		}
+	}
+	if *configPath == "" {
+		*configPath = filepath.Join(*path, "config.json")
+	}
+	iface := &Interface{Name: *interfaceName}
+	for _, p := range []string{iface.ConfigPath(), *configPath} {
+		if _, err := os.Stat(p); err == nil && !*force {
+			return fmt.Errorf("%s already exists, pass -force to overwrite it", p)
+		}
+	}
+
+	// create server keys
+	privateKeyBytes, err := exec.Command("wg", "genkey").Output()
+	if err != nil {
+		return err
+	}
+	privateKey := strings.TrimSpace(string(privateKeyBytes))
+	publicKey, err := wgPubkey(privateKey)
+	if err != nil {
+		return err
+	}
+
+	// write interface config
+	var interfaceConfig strings.Builder
+	err = template.Must(template.New("interface").Parse(interfaceConfigTemplate)).Execute(&interfaceConfig, interfaceConfigData{
+		Address:    prefix.String(),
+		Network:    prefix.Masked().String(),
+		ListenPort: *listenPort,
+		PrivateKey: privateKey,
+		Outbound:   *outbound,
+	})
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(iface.ConfigPath()), 0700); err != nil {
+		return err
+	}
+	if err = os.WriteFile(iface.ConfigPath(), []byte(interfaceConfig.String()), 0600); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %s\n", iface.ConfigPath())
+
+	// write config.json
+	setupConfig := map[string]interface{}{
+		"mongoURI":             *mongoURI,
+		"dbName":               *dbName,
+		"collectionName":       *collectionName,
+		"interfaceName":        *interfaceName,
+		"serverEndpoint":       net.JoinHostPort(*endpoint, strconv.Itoa(*listenPort)),
+		"serverPublicKey":      publicKey,
+		"serverNetworkAddress": prefix.String(),
+		"path":                 *path,
+		"dnsServers":           *dnsServers,
+	}
+	configBytes, err := json.MarshalIndent(setupConfig, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(*configPath, configBytes, 0600); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %s\n", *configPath)
+	if *mongoURI == "" {
+		fmt.Println("set mongoURI in config.json before starting the server")
+	}
+
+	// bring interface up
+	if *up {
+		out, err := exec.Command("wg-quick", "up", *interfaceName).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("wg-quick up %s: %s: %s", *interfaceName, err, out)
+		}
+		out, err = exec.Command("systemctl", "enable", "wg-quick@"+*interfaceName).CombinedOutput()
+		if err != nil {
+			fmt.Printf("could not enable wg-quick@%s on boot: %s: %s\n", *interfaceName, err, out)
+		}
+		fmt.Printf("interface %s is up\n", *interfaceName)
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// storeTimeout bounds every buffered write so a database outage can't stall the update loop
+const storeTimeout = 5 * time.Second
+
+// maxFlushBackoff is the longest wait between flush attempts while the database is unreachable
+const maxFlushBackoff = time.Minute
+
+type StoreStatus struct {
+	Connected bool `json:"connected"`
+	// Degraded is true while writes fail, peers keep being enforced from memory and writes are retried
+	Degraded      bool   `json:"degraded"`
+	LastError     string `json:"lastError,omitempty"`
+	LastErrorAt   int64  `json:"lastErrorAt,omitempty"`
+	LastSuccessAt int64  `json:"lastSuccessAt"`
+	PendingWrites int    `json:"pendingWrites"`
+}
+
+var store = struct {
+	sync.Mutex
+	// usage and fields that haven't reached the database yet, keyed by peer id
+	usage       map[primitive.ObjectID]uint64
+	fields      map[primitive.ObjectID]bson.M
+	status      StoreStatus
+	backoff     time.Duration
+	nextFlushAt time.Time
+}{
+	usage:  map[primitive.ObjectID]uint64{},
+	fields: map[primitive.ObjectID]bson.M{},
+	status: StoreStatus{Connected: true},
+}
+
+// queueUsage adds bytes to the peer's stored total usage on the next flush
+func queueUsage(peer *Peer, bytes uint64) {
+	store.Lock()
+	defer store.Unlock()
+	store.usage[peer.ID] += bytes
+}
+
+// queueFields sets fields of the peer's stored document on the next flush, later values replace earlier ones
+func queueFields(peer *Peer, fields bson.M) {
+	store.Lock()
+	defer store.Unlock()
+	if store.fields[peer.ID] == nil {
+		store.fields[peer.ID] = bson.M{}
+	}
+	for k, v := range fields {
+		store.fields[peer.ID][k] = v
+	}
+}
+
+// discardQueuedUsage drops usage that hasn't been written yet, used when the stored usage is reset
+func discardQueuedUsage(peer *Peer) {
+	store.Lock()
+	defer store.Unlock()
+	delete(store.usage, peer.ID)
+}
+
+// discardQueuedWrites drops every queued write, used when all stored peers are replaced
+func discardQueuedWrites() {
+	store.Lock()
+	defer store.Unlock()
+	store.usage = map[primitive.ObjectID]uint64{}
+	store.fields = map[primitive.ObjectID]bson.M{}
+}
+
+// queuedWrites returns the usage and whether there are fields of the peer that haven't reached the database
+func queuedWrites(peer *Peer) (usage uint64, fields bool) {
+	store.Lock()
+	defer store.Unlock()
+	return store.usage[peer.ID], store.fields[peer.ID] != nil
+}
+
+// recordStoreResult updates the store status after any database call
+func recordStoreResult(err error) {
+	store.Lock()
+	defer store.Unlock()
+	recordStoreResultLocked(err)
+}
+
+func recordStoreResultLocked(err error) {
+	now := time.Now()
+	if err != nil {
+		if !store.status.Degraded {
+			slog.Error("database unavailable, continuing from memory", "error", err)
+		}
+		store.status.Connected = !isConnectionError(err)
+		store.status.Degraded = true
+		store.status.LastError = err.Error()
+		store.status.LastErrorAt = now.Unix()
+		return
+	}
+	if store.status.Degraded {
+		slog.Info("database is reachable again")
+	}
+	store.status.Connected = true
+	store.status.Degraded = false
+	store.status.LastSuccessAt = now.Unix()
+}
+
+func isConnectionError(err error) bool {
+	return mongo.IsNetworkError(err) || mongo.IsTimeout(err) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, mongo.ErrClientDisconnected)
+}
+
+func storeStatus() StoreStatus {
+	store.Lock()
+	defer store.Unlock()
+	status := store.status
+	status.PendingWrites = len(store.usage) + len(store.fields)
+	return status
+}
+
+// flushQueuedWrites writes the queued usage and fields in one bulk write. Failed writes stay queued and are retried
+// with growing intervals, unless force is set, as on shutdown.
+func flushQueuedWrites(force bool) error {
+	store.Lock()
+	if len(store.usage) == 0 && len(store.fields) == 0 || !force && time.Now().Before(store.nextFlushAt) {
+		store.Unlock()
+		return nil
+	}
+
+	// every operation remembers what it writes so only failed ones are queued again
+	type queued struct {
+		id     primitive.ObjectID
+		usage  uint64
+		fields bson.M
+	}
+	var operations []mongo.WriteModel
+	var written []queued
+	for id, usage := range store.usage {
+		operations = append(operations, mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": id}).SetUpdate(bson.M{"$inc": bson.M{"totalUsage": usage}}))
+		written = append(written, queued{id: id, usage: usage})
+	}
+	for id, fields := range store.fields {
+		operations = append(operations, mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": id}).SetUpdate(bson.M{"$set": fields}))
+		written = append(written, queued{id: id, fields: fields})
+	}
+	store.usage = map[primitive.ObjectID]uint64{}
+	store.fields = map[primitive.ObjectID]bson.M{}
+	store.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	_, err := config.Collection.BulkWrite(ctx, operations, options.BulkWrite().SetOrdered(false))
+
+	store.Lock()
+	defer store.Unlock()
+	if err != nil {
+		requeue := written
+		var bulkErr mongo.BulkWriteException
+		if errors.As(err, &bulkErr) && bulkErr.WriteConcernError == nil && len(bulkErr.WriteErrors) > 0 {
+			// only the listed operations failed, the rest are already stored
+			requeue = nil
+			for _, e := range bulkErr.WriteErrors {
+				requeue = append(requeue, written[e.Index])
+			}
+		}
+		for _, q := range requeue {
+			if q.fields == nil {
+				store.usage[q.id] += q.usage
+				continue
+			}
+			// fields queued while writing are newer and win
+			if store.fields[q.id] == nil {
+				store.fields[q.id] = bson.M{}
+			}
+			for k, v := range q.fields {
+				if _, ok := store.fields[q.id][k]; !ok {
+					store.fields[q.id][k] = v
+				}
+			}
+		}
+		if store.backoff == 0 {
+			store.backoff = time.Second
+		} else if store.backoff < maxFlushBackoff {
+			store.backoff *= 2
+		}
+		store.nextFlushAt = time.Now().Add(store.backoff)
+		recordStoreResultLocked(err)
+		return err
+	}
+	store.backoff = 0
+	recordStoreResultLocked(nil)
+	return nil
+}
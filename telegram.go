@@ -0,0 +1,570 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const telegramPeersPerPage = 20
+
+// telegramOutbox holds what the bot's handlers send while they hold updateMutex. The update loop sends it once the lock
+// is released, so a slow Telegram API doesn't hold up the api and the update loop.
+var telegramOutbox []tgbotapi.Chattable
+
+// queueTelegram adds messages to the ones sent after the running handler, the caller holds updateMutex
+func queueTelegram(c ...tgbotapi.Chattable) {
+	telegramOutbox = append(telegramOutbox, c...)
+}
+
+func runTelegramBot() {
+	updateMutex.RLock()
+	token := config.TelegramBotToken
+	updateMutex.RUnlock()
+	bot, err := tgbotapi.NewBotAPI(token)
+	if err != nil {
+		slog.Error("could not connect telegram bot", "error", err)
+		return
+	}
+	updateMutex.Lock()
+	config.TelegramBot = bot
+	updateMutex.Unlock()
+	slog.Info("telegram bot connected", "username", bot.Self.UserName)
+	u := tgbotapi.NewUpdate(0)
+	u.Timeout = 60
+	updates := bot.GetUpdatesChan(u)
+	for update := range updates {
+		// commands read and change peers like api requests do, their replies are sent after the lock is released
+		updateMutex.Lock()
+		if update.CallbackQuery != nil {
+			handleTelegramCallback(update.CallbackQuery)
+		} else if update.Message != nil && update.Message.Command() != "" {
+			// check if message is command
+			handleTelegramCommand(update.Message)
+		}
+		outbox := telegramOutbox
+		telegramOutbox = nil
+		updateMutex.Unlock()
+		for _, c := range outbox {
+			if _, err := bot.Request(c); err != nil {
+				slog.Warn("could not send telegram message", "error", err)
+			}
+		}
+	}
+}
+
+func replyTelegram(m *tgbotapi.Message, text string) {
+	msg := tgbotapi.NewMessage(m.Chat.ID, text)
+	msg.ReplyToMessageID = m.MessageID
+	queueTelegram(msg)
+}
+
+func handleTelegramStart(m *tgbotapi.Message) {
+	tt := m.CommandArguments()
+	// check if arg is peer's telegram token
+	if len(tt) != 36 {
+		return
+	}
+	p := Peer{}
+	res := config.Collection.FindOne(context.Background(), bson.M{"telegramToken": tt})
+	err := res.Decode(&p)
+	if err != nil {
+		slog.Warn("could not find peer for telegram token", "chatID", m.Chat.ID, "error", err)
+		replyTelegram(m, "درخواست نامعتبر")
+		return
+	}
+	peer := config.Peers[p.PublicKey]
+	if peer == nil {
+		replyTelegram(m, "درخواست نامعتبر")
+		return
+	}
+	if slices.Contains(peer.TelegramChatIDs, m.Chat.ID) {
+		replyTelegram(m, fmt.Sprintf(`اشتراک شما "%s" قبلا ثبت شده است`, peer.Name))
+		return
+	}
+	if config.MaxTelegramSubscribers > 0 && len(peer.TelegramChatIDs) >= config.MaxTelegramSubscribers {
+		replyTelegram(m, fmt.Sprintf(`تعداد چت های ثبت شده برای اشتراک "%s" به حداکثر رسیده است`, peer.Name))
+		return
+	}
+	_, err = config.Collection.UpdateOne(
+		context.TODO(),
+		bson.M{"telegramToken": tt},
+		bson.M{"$addToSet": bson.M{"telegramChatIDs": m.Chat.ID}})
+	if err != nil {
+		slog.Error("could not link telegram chat", peerLog(&p), "chatID", m.Chat.ID, "error", err)
+		replyTelegram(m, "درخواست نامعتبر")
+		return
+	}
+	peer.TelegramChatIDs = append(peer.TelegramChatIDs, m.Chat.ID)
+	replyTelegram(m, fmt.Sprintf(`اشتراک شما "%s" ثبت شد`, peer.Name))
+}
+
+// handleTelegramUnlink removes the chat from the named peer, or from every peer it is linked to if no name is given
+func handleTelegramUnlink(m *tgbotapi.Message) {
+	name := strings.TrimSpace(m.CommandArguments())
+	var names []string
+	for _, p := range findPeersByTelegramChatID(m.Chat.ID) {
+		if name != "" && p.Name != name {
+			continue
+		}
+		if err := unlinkTelegramChat(p, m.Chat.ID); err != nil {
+			slog.Error("could not unlink telegram chat", peerLog(p), "chatID", m.Chat.ID, "error", err)
+			replyTelegram(m, "درخواست نامعتبر")
+			return
+		}
+		names = append(names, p.Name)
+	}
+	if len(names) == 0 {
+		replyTelegram(m, "اشتراکی برای این چت ثبت نشده است")
+		return
+	}
+	replyTelegram(m, fmt.Sprintf(`اشتراک "%s" از این چت حذف شد`, strings.Join(names, `"، "`)))
+}
+
+func unlinkTelegramChat(peer *Peer, chatID int64) error {
+	_, err := config.Collection.UpdateOne(
+		context.TODO(),
+		bson.M{"publicKey": peer.PublicKey},
+		bson.M{"$pull": bson.M{"telegramChatIDs": chatID, "telegramOperatorChatIDs": chatID}})
+	if err != nil {
+		return err
+	}
+	peer.TelegramChatIDs = slices.DeleteFunc(peer.TelegramChatIDs, func(id int64) bool { return id == chatID })
+	peer.TelegramOperatorChatIDs = slices.DeleteFunc(peer.TelegramOperatorChatIDs, func(id int64) bool { return id == chatID })
+	return nil
+}
+
+// handleTelegramOperator lets the chat manage peers from the bot on behalf of the admin and distributor peers it is linked to,
+// once it sends the operator secret. A telegram token alone only subscribes a chat to notifications.
+func handleTelegramOperator(m *tgbotapi.Message) {
+	// the secret shouldn't stay in the chat history
+	queueTelegram(tgbotapi.NewDeleteMessage(m.Chat.ID, m.MessageID))
+	// replies can't quote the deleted message
+	reply := func(text string) {
+		queueTelegram(tgbotapi.NewMessage(m.Chat.ID, text))
+	}
+	secret := strings.TrimSpace(m.CommandArguments())
+	if config.TelegramOperatorSecret == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(config.TelegramOperatorSecret)) != 1 {
+		slog.Warn("telegram chat sent a wrong operator secret", "chatID", m.Chat.ID)
+		reply("درخواست نامعتبر")
+		return
+	}
+	var names []string
+	for _, p := range findPeersByTelegramChatID(m.Chat.ID) {
+		if p.Role != "admin" && p.Role != "distributor" {
+			continue
+		}
+		_, err := config.Collection.UpdateOne(
+			context.TODO(),
+			bson.M{"publicKey": p.PublicKey},
+			bson.M{"$addToSet": bson.M{"telegramOperatorChatIDs": m.Chat.ID}})
+		if err != nil {
+			slog.Error("could not verify telegram operator chat", peerLog(p), "chatID", m.Chat.ID, "error", err)
+			reply("درخواست نامعتبر")
+			return
+		}
+		if !slices.Contains(p.TelegramOperatorChatIDs, m.Chat.ID) {
+			p.TelegramOperatorChatIDs = append(p.TelegramOperatorChatIDs, m.Chat.ID)
+		}
+		names = append(names, p.Name)
+	}
+	if len(names) == 0 {
+		reply("اشتراک مدیر یا فروشنده ای برای این چت ثبت نشده است")
+		return
+	}
+	slog.Info("verified telegram operator chat", "chatID", m.Chat.ID, "peers", names)
+	reply(fmt.Sprintf(`مدیریت اشتراک "%s" از این چت فعال شد`, strings.Join(names, `"، "`)))
+}
+
+// rotateTelegramToken gives the peer a new telegram token so the old one can no longer link chats, and optionally unlinks all current chats
+func rotateTelegramToken(peer *Peer, unlink bool) error {
+	tt := uuid.New().String()
+	update := bson.M{"telegramToken": tt}
+	if unlink {
+		update["telegramChatIDs"] = []int64{}
+		update["telegramOperatorChatIDs"] = []int64{}
+	}
+	_, err := config.Collection.UpdateOne(context.TODO(), bson.M{"publicKey": peer.PublicKey}, bson.M{"$set": update})
+	if err != nil {
+		return err
+	}
+	peer.TelegramToken = tt
+	if unlink {
+		peer.TelegramChatIDs = []int64{}
+		peer.TelegramOperatorChatIDs = nil
+	}
+	return nil
+}
+
+// isDeadChatError reports whether sending to a chat failed because the bot was blocked, removed or the chat no longer exists
+func isDeadChatError(err error) bool {
+	var tgErr *tgbotapi.Error
+	if !errors.As(err, &tgErr) {
+		return false
+	}
+	return tgErr.Code == 403 || (tgErr.Code == 400 && strings.Contains(tgErr.Message, "chat not found"))
+}
+
+// notifyTelegramChats sends text to every chat subscribed to the peer and unsubscribes chats that can no longer be reached
+func notifyTelegramChats(peer *Peer, text string) {
+	if config.TelegramBot == nil {
+		return
+	}
+	for _, chatID := range slices.Clone(peer.TelegramChatIDs) {
+		_, err := config.TelegramBot.Send(tgbotapi.NewMessage(chatID, text))
+		if err == nil {
+			continue
+		}
+		slog.Warn("could not notify telegram chat", peerLog(peer), "chatID", chatID, "error", err)
+		if isDeadChatError(err) {
+			unlinkDeadTelegramChat(chatID)
+		}
+	}
+}
+
+// unlinkDeadTelegramChat unlinks a chat the bot can no longer reach from all its peers, the caller holds updateMutex
+func unlinkDeadTelegramChat(chatID int64) {
+	for _, p := range findPeersByTelegramChatID(chatID) {
+		if err := unlinkTelegramChat(p, chatID); err != nil {
+			slog.Error("could not unlink telegram chat", peerLog(p), "chatID", chatID, "error", err)
+		}
+	}
+}
+
+// telegramNotice is a message for a chat subscribed to a peer
+type telegramNotice struct {
+	chatID  int64
+	message tgbotapi.Chattable
+}
+
+// sendTelegramNotices sends notices about the peer logged as log without holding updateMutex, then unlinks the chats
+// that can no longer be reached
+func sendTelegramNotices(bot *tgbotapi.BotAPI, notices []telegramNotice, log slog.Attr) {
+	dead := map[int64]bool{}
+	for _, n := range notices {
+		if dead[n.chatID] {
+			continue
+		}
+		if _, err := bot.Request(n.message); err != nil {
+			slog.Warn("could not notify telegram chat", log, "chatID", n.chatID, "error", err)
+			dead[n.chatID] = isDeadChatError(err)
+		}
+	}
+	updateMutex.Lock()
+	defer updateMutex.Unlock()
+	for chatID, isDead := range dead {
+		if isDead {
+			unlinkDeadTelegramChat(chatID)
+		}
+	}
+}
+
+// telegramOperator returns the admin or distributor peer the chat was verified for with the operator secret, or nil if there is none
+func telegramOperator(chatID int64) *Peer {
+	var operator *Peer
+	for _, p := range findPeersByTelegramChatID(chatID) {
+		if config.TelegramOperatorSecret == "" || !slices.Contains(p.TelegramOperatorChatIDs, chatID) {
+			continue
+		}
+		if p.Role == "admin" {
+			return p
+		}
+		if p.Role == "distributor" {
+			operator = p
+		}
+	}
+	return operator
+}
+
+func handleTelegramCommand(m *tgbotapi.Message) {
+	switch m.Command() {
+	case "start":
+		handleTelegramStart(m)
+		return
+	case "unlink":
+		handleTelegramUnlink(m)
+		return
+	case "operator":
+		handleTelegramOperator(m)
+		return
+	}
+
+	operator := telegramOperator(m.Chat.ID)
+	if operator == nil {
+		replyTelegram(m, "دسترسی ندارید")
+		return
+	}
+	args := strings.Fields(m.CommandArguments())
+
+	switch m.Command() {
+	case "peers":
+		msg := tgbotapi.NewMessage(m.Chat.ID, "اشتراک ها")
+		msg.ReplyMarkup = telegramPeersKeyboard(operator, 0)
+		queueTelegram(msg)
+	case "plans":
+		if len(config.Plans) == 0 {
+			replyTelegram(m, "پلنی تعریف نشده است")
+			return
+		}
+		var lines []string
+		for _, plan := range config.Plans {
+			lines = append(lines, fmt.Sprintf("%s: %d روز، %d گیگابایت", plan.Name, plan.Days, plan.AllowedUsage/gigabyte))
+		}
+		replyTelegram(m, strings.Join(lines, "\n"))
+	case "create":
+		if len(args) != 2 {
+			replyTelegram(m, "/create <name> <plan>")
+			return
+		}
+		if !canManage(operator, args[0]) {
+			replyTelegram(m, "دسترسی ندارید")
+			return
+		}
+		plan := findPlan(args[1])
+		if plan == nil {
+			replyTelegram(m, "پلن یافت نشد")
+			return
+		}
+		p, err := createPeer(args[0], "user", "", plan)
+		if err != nil {
+			slog.Warn("could not create peer from telegram", "name", args[0], "operator", operator.Name, "error", err)
+			replyTelegram(m, "درخواست نامعتبر")
+			return
+		}
+		replyTelegram(m, fmt.Sprintf(`اشتراک "%s" ساخته شد`, p.Name))
+		queueTelegram(telegramPeerConfig(m.Chat.ID, p)...)
+	case "config":
+		if len(args) != 1 {
+			replyTelegram(m, "/config <name>")
+			return
+		}
+		if !canManage(operator, args[0]) {
+			replyTelegram(m, "دسترسی ندارید")
+			return
+		}
+		p := findPeerByName(args[0])
+		if p == nil {
+			replyTelegram(m, "کاربر یافت نشد")
+			return
+		}
+		queueTelegram(telegramPeerConfig(m.Chat.ID, p)...)
+	case "extend", "addgb":
+		if len(args) != 2 {
+			replyTelegram(m, fmt.Sprintf("/%s <name> <amount>", m.Command()))
+			return
+		}
+		replyTelegram(m, applyTelegramAction(operator, m.Command(), args[1], args[0]))
+	case "suspend":
+		if len(args) < 1 {
+			replyTelegram(m, "/suspend <name> [reason]")
+			return
+		}
+		replyTelegram(m, applyTelegramAction(operator, m.Command(), strings.Join(args[1:], " "), args[0]))
+	case "reset", "resume":
+		if len(args) != 1 {
+			replyTelegram(m, fmt.Sprintf("/%s <name>", m.Command()))
+			return
+		}
+		replyTelegram(m, applyTelegramAction(operator, m.Command(), "", args[0]))
+	default:
+		replyTelegram(m, "/unlink [name]\n/operator <secret>\n/peers\n/plans\n/create <name> <plan>\n/config <name>\n/extend <name> <days>\n/addgb <name> <gb>\n/reset <name>\n/suspend <name> [reason]\n/resume <name>")
+	}
+}
+
+// applyTelegramAction runs a peer operation on behalf of the operator and returns the reply for the chat
+func applyTelegramAction(operator *Peer, action string, arg string, name string) string {
+	if !canManage(operator, name) {
+		return "دسترسی ندارید"
+	}
+	peer := findPeerByName(name)
+	if peer == nil {
+		return "کاربر یافت نشد"
+	}
+
+	var err error
+	var reply string
+	switch action {
+	case "extend":
+		days, parseErr := strconv.ParseUint(arg, 10, 64)
+		if parseErr != nil || days == 0 {
+			return "درخواست نامعتبر"
+		}
+		err = extendPeer(peer, days)
+		reply = fmt.Sprintf(`%d روز به اشتراک "%s" اضافه شد`, days, peer.Name)
+	case "addgb":
+		gigs, parseErr := strconv.ParseUint(arg, 10, 64)
+		if parseErr != nil || gigs == 0 {
+			return "درخواست نامعتبر"
+		}
+		err = addPeerUsage(peer, gigs*gigabyte)
+		reply = fmt.Sprintf(`%d گیگابایت به اشتراک "%s" اضافه شد`, gigs, peer.Name)
+	case "reset":
+		err = resetPeerUsage(peer)
+		reply = fmt.Sprintf(`مصرف اشتراک "%s" صفر شد`, peer.Name)
+	case "suspend":
+		err = setPeerDisabled(peer, true, arg, operator.Name)
+		reply = fmt.Sprintf(`اشتراک "%s" مسدود شد`, peer.Name)
+	case "resume":
+		err = setPeerDisabled(peer, false, "", operator.Name)
+		reply = fmt.Sprintf(`اشتراک "%s" فعال شد`, peer.Name)
+	default:
+		return "درخواست نامعتبر"
+	}
+	if err != nil {
+		slog.Error("telegram action failed", peerLog(peer), "action", action, "error", err)
+		return "درخواست نامعتبر"
+	}
+	// suspend and resume take effect right away, like from the api
+	if action == "suspend" || action == "resume" {
+		if err = applyPeerState(peer); err != nil {
+			slog.Error("could not apply peer state", peerLog(peer), "action", action, "error", err)
+		}
+	}
+	return reply
+}
+
+// telegramPeerConfig returns the messages with the peer's config file and its QR code for the chat
+func telegramPeerConfig(chatID int64, peer *Peer) []tgbotapi.Chattable {
+	doc := tgbotapi.NewDocument(chatID, tgbotapi.FileBytes{Name: peer.Name + ".conf", Bytes: []byte(generateConfig(peer))})
+	qr, err := peerQRCodePNG(peer, defaultQRCodeSize)
+	if err != nil {
+		slog.Error("could not create QR code", peerLog(peer), "error", err)
+		return []tgbotapi.Chattable{doc}
+	}
+	photo := tgbotapi.NewPhoto(chatID, tgbotapi.FileBytes{Name: peer.Name + ".png", Bytes: qr})
+	photo.Caption = peer.Name
+	return []tgbotapi.Chattable{doc, photo}
+}
+
+func telegramPeersKeyboard(operator *Peer, page int) tgbotapi.InlineKeyboardMarkup {
+	var peers []*Peer
+	for _, p := range config.Peers {
+		if canManage(operator, p.Name) {
+			peers = append(peers, p)
+		}
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Name < peers[j].Name })
+
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for i := page * telegramPeersPerPage; i < len(peers) && i < (page+1)*telegramPeersPerPage; i++ {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData(peers[i].Name, "peer::"+peers[i].Name)))
+	}
+	var navigation []tgbotapi.InlineKeyboardButton
+	if page > 0 {
+		navigation = append(navigation, tgbotapi.NewInlineKeyboardButtonData("«", fmt.Sprintf("peers:%d:", page-1)))
+	}
+	if (page+1)*telegramPeersPerPage < len(peers) {
+		navigation = append(navigation, tgbotapi.NewInlineKeyboardButtonData("»", fmt.Sprintf("peers:%d:", page+1)))
+	}
+	if len(navigation) > 0 {
+		rows = append(rows, navigation)
+	}
+	return tgbotapi.InlineKeyboardMarkup{InlineKeyboard: rows}
+}
+
+func telegramPeerSummary(p *Peer) string {
+	status := "فعال"
+	if p.Suspended || p.Disabled {
+		status = "مسدود"
+	}
+	var days uint64
+	if now := uint64(time.Now().Unix()); p.ExpiresAt > now {
+		days = (p.ExpiresAt - now) / 86400
+	}
+	summary := fmt.Sprintf("%s\nوضعیت: %s\nروزهای باقیمانده: %d\nمصرف: %.2f / %.2f گیگابایت",
+		p.Name, status, days, float64(p.TotalUsage)/gigabyte, float64(p.AllowedUsage)/gigabyte)
+	if p.Disabled && p.DisabledReason != "" {
+		summary += "\nدلیل مسدودی: " + p.DisabledReason
+	}
+	return summary
+}
+
+func telegramPeerKeyboard(p *Peer) tgbotapi.InlineKeyboardMarkup {
+	toggle := tgbotapi.NewInlineKeyboardButtonData("مسدود کردن", "suspend::"+p.Name)
+	if p.Disabled {
+		toggle = tgbotapi.NewInlineKeyboardButtonData("فعال کردن", "resume::"+p.Name)
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("+30 روز", "extend:30:"+p.Name),
+			tgbotapi.NewInlineKeyboardButtonData("+10 گیگابایت", "addgb:10:"+p.Name),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("صفر کردن مصرف", "reset::"+p.Name),
+			toggle,
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("کانفیگ", "config::"+p.Name),
+			tgbotapi.NewInlineKeyboardButtonData("بازگشت", "peers:0:"),
+		),
+	)
+}
+
+// handleTelegramCallback handles inline keyboard presses, callback data has the form "action:arg:name"
+func handleTelegramCallback(q *tgbotapi.CallbackQuery) {
+	if q.Message == nil {
+		return
+	}
+	chatID := q.Message.Chat.ID
+	operator := telegramOperator(chatID)
+	if operator == nil {
+		queueTelegram(tgbotapi.NewCallback(q.ID, "دسترسی ندارید"))
+		return
+	}
+	parts := strings.SplitN(q.Data, ":", 3)
+	if len(parts) != 3 {
+		queueTelegram(tgbotapi.NewCallback(q.ID, "درخواست نامعتبر"))
+		return
+	}
+	action, arg, name := parts[0], parts[1], parts[2]
+	// buttons sent before a rename carry the old name
+	if p := findPeerByAnyName(name); p != nil {
+		name = p.Name
+	}
+
+	answer := ""
+	switch action {
+	case "peers":
+		page, _ := strconv.Atoi(arg)
+		queueTelegram(tgbotapi.NewEditMessageTextAndMarkup(chatID, q.Message.MessageID, "اشتراک ها", telegramPeersKeyboard(operator, page)))
+	case "peer":
+		if !canManage(operator, name) {
+			answer = "دسترسی ندارید"
+			break
+		}
+		p := findPeerByName(name)
+		if p == nil {
+			answer = "کاربر یافت نشد"
+			break
+		}
+		queueTelegram(tgbotapi.NewEditMessageTextAndMarkup(chatID, q.Message.MessageID, telegramPeerSummary(p), telegramPeerKeyboard(p)))
+	case "config":
+		if !canManage(operator, name) {
+			answer = "دسترسی ندارید"
+			break
+		}
+		p := findPeerByName(name)
+		if p == nil {
+			answer = "کاربر یافت نشد"
+			break
+		}
+		queueTelegram(telegramPeerConfig(chatID, p)...)
+	default:
+		answer = applyTelegramAction(operator, action, arg, name)
+		if p := findPeerByName(name); p != nil && canManage(operator, name) {
+			queueTelegram(tgbotapi.NewEditMessageTextAndMarkup(chatID, q.Message.MessageID, telegramPeerSummary(p), telegramPeerKeyboard(p)))
+		}
+	}
+	queueTelegram(tgbotapi.NewCallback(q.ID, answer))
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// errTrashNameTaken is returned when a peer is deleted while an older peer of the same name is in the trash. Names in
+// the trash stay unique, an admin purges the older one or renames the peer first.
+var errTrashNameTaken = errors.New("a peer with this name is already in the trash, purge it or rename this peer first")
+
+// canTrashPeer checks that the peer can go to the trash before it is taken off its interface
+func canTrashPeer(peer *Peer) error {
+	if findTrashedPeer(peer.Name) != nil {
+		return errTrashNameTaken
+	}
+	return nil
+}
+
+// trashPeer moves a peer that is no longer on its interface to the trash, where it keeps its keys and usage until it is
+// restored or purged. Callers check canTrashPeer before they take the peer off its interface.
+func trashPeer(peer *Peer, actor string) error {
+	if err := canTrashPeer(peer); err != nil {
+		return err
+	}
+	now := uint64(time.Now().Unix())
+	_, err := config.Collection.UpdateOne(
+		context.TODO(),
+		bson.M{"publicKey": peer.PublicKey},
+		bson.M{"$set": bson.M{"deletedAt": now, "deletedBy": actor}, "$unset": bson.M{"retiredKey": ""}})
+	if err != nil {
+		return err
+	}
+	peer.DeletedAt, peer.DeletedBy = now, actor
+	// removePeerConfig took the retired key off the interface too
+	peer.RetiredKey = nil
+	delete(config.Peers, peer.PublicKey)
+	config.Trash[peer.PublicKey] = peer
+	slog.Info("moved peer to trash", peerLog(peer), "actor", actor)
+	emitWebhook(webhookPeerDeleted, peer, map[string]interface{}{"trash": true})
+	return nil
+}
+
+func findTrashedPeer(name string) *Peer {
+	for _, p := range config.Trash {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// trashedPeers returns the peers in the trash that client may manage, the most recently deleted first
+func trashedPeers(client *Peer) []*Peer {
+	peers := []*Peer{}
+	for _, p := range config.Trash {
+		if canManage(client, p.Name) {
+			peers = append(peers, p)
+		}
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		if peers[i].DeletedAt != peers[j].DeletedAt {
+			return peers[i].DeletedAt > peers[j].DeletedAt
+		}
+		return peers[i].Name < peers[j].Name
+	})
+	return peers
+}
+
+// restorePeer puts a peer from the trash back on its interface, on its old address if that is still free.
+// Peers that expired, ran over their allowed usage or are disabled come back suspended. The caller holds updateMutex.
+func restorePeer(name string) (*Peer, error) {
+	peer := findTrashedPeer(name)
+	if peer == nil {
+		return nil, errors.New("peer not found in trash")
+	}
+	if findPeerByName(peer.Name) != nil {
+		return nil, errors.New("another peer is named " + peer.Name + " now, rename or delete it first")
+	}
+	iface, err := appendPeerConfig(peer)
+	if err != nil {
+		return nil, err
+	}
+	// take the peer out of the config file again if it can't be restored
+	undo := func() {
+		if configBytes, readErr := os.ReadFile(iface.ConfigPath()); readErr == nil {
+			os.WriteFile(iface.ConfigPath(), []byte(removePeerSections(string(configBytes), map[string]bool{peer.PublicKey: true})), 0644)
+		}
+	}
+	suspended := peerCutOff(peer)
+	if suspended {
+		if _, err = suspendPeerConfig(peer); err != nil {
+			undo()
+			return nil, err
+		}
+	}
+	if err = iface.Sync(); err != nil {
+		undo()
+		return nil, err
+	}
+	_, err = config.Collection.UpdateOne(
+		context.TODO(),
+		bson.M{"publicKey": peer.PublicKey},
+		bson.M{
+			"$set":   bson.M{"address": peer.Address, "interface": peer.Interface, "suspended": suspended},
+			"$unset": bson.M{"deletedAt": "", "deletedBy": ""},
+		})
+	if err != nil {
+		undo()
+		if syncErr := iface.Sync(); syncErr != nil {
+			slog.Error("could not take back restored peer", peerLog(peer), "interface", iface.Name, "error", syncErr)
+		}
+		return nil, err
+	}
+
+	peer.DeletedAt, peer.DeletedBy = 0, ""
+	peer.Suspended = suspended
+	delete(config.Trash, peer.PublicKey)
+	config.Peers[peer.PublicKey] = peer
+	// the device starts the restored peer's transfer from zero, earlier usage is already counted
+	loadTransferCounters(map[string]bool{peer.PublicKey: true})
+	slog.Info("restored peer", peerLog(peer), "address", peer.Address, "suspended", suspended)
+	emitWebhook(webhookPeerRestored, peer, nil)
+	return peer, nil
+}
+
+// purgePeer deletes a peer in the trash for good
+func purgePeer(peer *Peer) error {
+	_, err := config.Collection.DeleteOne(context.TODO(), bson.M{"publicKey": peer.PublicKey})
+	if err != nil {
+		return err
+	}
+	delete(config.Trash, peer.PublicKey)
+	slog.Info("purged peer", peerLog(peer))
+	emitWebhook(webhookPeerPurged, peer, nil)
+	return nil
+}
+
+// purgeExpiredTrash purges the peers that have been in the trash for longer than config.TrashDays
+func purgeExpiredTrash() {
+	if config.TrashDays < 0 {
+		return
+	}
+	cutoff := uint64(time.Now().Unix()) - uint64(config.TrashDays)*86400
+	for _, p := range config.Trash {
+		if p.DeletedAt < cutoff {
+			if err := purgePeer(p); err != nil {
+				slog.Error("could not purge peer from trash", peerLog(p), "error", err)
+			}
+		}
+	}
+}
+
+func runTrashPurge() {
+	for ; ; time.Sleep(time.Hour) {
+		// the update loop replaces the trash when it reads the peers from the database
+		updateMutex.Lock()
+		purgeExpiredTrash()
+		updateMutex.Unlock()
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	webhookPeerCreated        = "peer.created"
+	webhookPeerDeleted        = "peer.deleted"
+	webhookPeerRenamed        = "peer.renamed"
+	webhookPeerExtended       = "peer.extended"
+	webhookPeerUsageReset     = "peer.usage_reset"
+	webhookPeerSuspended      = "peer.suspended"
+	webhookPeerRevived        = "peer.revived"
+	webhookPeerQuotaThreshold = "peer.quota_threshold"
+	webhookPeerRestored       = "peer.restored"
+	webhookPeerPurged         = "peer.purged"
+	webhookPeerKeysRotated    = "peer.keys_rotated"
+)
+
+const webhookMaxAttempts = 5
+
+// pendingWebhooks tracks deliveries still in progress so short lived commands can wait for them before exiting
+var pendingWebhooks sync.WaitGroup
+
+type Webhook struct {
+	URL    string `json:"url"`
+	Secret string `json:"secret"`
+	// Events limits the webhook to the listed events, an empty list subscribes to all of them
+	Events []string `json:"events"`
+}
+
+type WebhookPayload struct {
+	ID        string                 `json:"id"`
+	Event     string                 `json:"event"`
+	Timestamp int64                  `json:"timestamp"`
+	Peer      json.RawMessage        `json:"peer"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+}
+
+type WebhookDelivery struct {
+	ID          primitive.ObjectID `bson:"_id" json:"id"`
+	URL         string             `bson:"url" json:"url"`
+	Event       string             `bson:"event" json:"event"`
+	Payload     string             `bson:"payload" json:"payload"`
+	Attempts    int                `bson:"attempts" json:"attempts"`
+	StatusCode  int                `bson:"statusCode" json:"statusCode"`
+	Error       string             `bson:"error" json:"error"`
+	Delivered   bool               `bson:"delivered" json:"delivered"`
+	CreatedAt   int64              `bson:"createdAt" json:"createdAt"`
+	LastAttempt int64              `bson:"lastAttempt" json:"lastAttempt"`
+}
+
+// emitWebhook sends event to every webhook subscribed to it, the peer is serialized right away so later changes don't leak into the payload
+func emitWebhook(event string, peer *Peer, data map[string]interface{}) {
+	if len(config.Webhooks) == 0 {
+		return
+	}
+	// receivers aren't peers, they don't get the token that links a telegram chat to the peer
+	hidden := *peer
+	hidden.TelegramToken = ""
+	peerBytes, err := json.Marshal(&hidden)
+	if err != nil {
+		slog.Error("could not encode webhook payload", peerLog(peer), "event", event, "error", err)
+		return
+	}
+	payload := WebhookPayload{
+		ID:        primitive.NewObjectID().Hex(),
+		Event:     event,
+		Timestamp: time.Now().Unix(),
+		Peer:      peerBytes,
+		Data:      data,
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		slog.Error("could not encode webhook payload", peerLog(peer), "event", event, "error", err)
+		return
+	}
+	for _, w := range config.Webhooks {
+		if len(w.Events) > 0 && !slices.Contains(w.Events, event) {
+			continue
+		}
+		pendingWebhooks.Add(1)
+		go func(w Webhook) {
+			defer pendingWebhooks.Done()
+			deliverWebhook(w, event, body)
+		}(w)
+	}
+}
+
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliverWebhook posts body to the webhook, retrying with exponential backoff, and records every attempt in the delivery log
+func deliverWebhook(w Webhook, event string, body []byte) {
+	delivery := WebhookDelivery{
+		ID:        primitive.NewObjectID(),
+		URL:       w.URL,
+		Event:     event,
+		Payload:   string(body),
+		CreatedAt: time.Now().Unix(),
+	}
+	if config.WebhookDeliveries != nil {
+		if _, err := config.WebhookDeliveries.InsertOne(context.TODO(), delivery); err != nil {
+			slog.Warn("could not log webhook delivery", "event", event, "url", w.URL, "error", err)
+		}
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	backoff := time.Second
+	for delivery.Attempts < webhookMaxAttempts && !delivery.Delivered {
+		if delivery.Attempts > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		delivery.Attempts++
+		delivery.LastAttempt = time.Now().Unix()
+		delivery.StatusCode = 0
+		delivery.Error = ""
+
+		req, err := http.NewRequest("POST", w.URL, bytes.NewReader(body))
+		if err != nil {
+			delivery.Error = err.Error()
+			break
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Webhook-Event", event)
+		if w.Secret != "" {
+			req.Header.Set("X-Webhook-Signature", signWebhook(w.Secret, body))
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			delivery.Error = err.Error()
+		} else {
+			res.Body.Close()
+			delivery.StatusCode = res.StatusCode
+			delivery.Delivered = res.StatusCode >= 200 && res.StatusCode < 300
+			if !delivery.Delivered {
+				delivery.Error = res.Status
+			}
+		}
+
+		if config.WebhookDeliveries != nil {
+			_, err = config.WebhookDeliveries.UpdateOne(
+				context.TODO(),
+				bson.M{"_id": delivery.ID},
+				bson.M{"$set": bson.M{
+					"attempts":    delivery.Attempts,
+					"statusCode":  delivery.StatusCode,
+					"error":       delivery.Error,
+					"delivered":   delivery.Delivered,
+					"lastAttempt": delivery.LastAttempt,
+				}})
+			if err != nil {
+				slog.Warn("could not log webhook delivery", "event", event, "url", w.URL, "error", err)
+			}
+		}
+	}
+	if !delivery.Delivered {
+		slog.Error("webhook delivery failed", "event", event, "url", w.URL, "attempts", delivery.Attempts, "error", delivery.Error)
+	}
+}
+
+// latestWebhookDeliveries returns the most recent entries of the delivery log, newest first
+func latestWebhookDeliveries(limit int64) ([]WebhookDelivery, error) {
+	deliveries := []WebhookDelivery{}
+	if config.WebhookDeliveries == nil {
+		return deliveries, nil
+	}
+	cursor, err := config.WebhookDeliveries.Find(context.TODO(), bson.D{}, options.Find().SetSort(bson.M{"createdAt": -1}).SetLimit(limit))
+	if err != nil {
+		return nil, err
+	}
+	err = cursor.All(context.TODO(), &deliveries)
+	return deliveries, err
+}